@@ -0,0 +1,112 @@
+// Command roombasim emulates a Roomba on a pseudo-terminal so jrkbr can run without hardware.
+//
+// Usage:
+//
+//	roombasim [-width 4000] [-height 3000]
+//	jrkbr <printed pty path>
+//
+// Sending SIGUSR1 makes a robot in safe mode drop to passive, as it would at a cliff.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stepInterval matches the 15 ms sensor update rate of a real Roomba
+const stepInterval = 15 * time.Millisecond
+
+func main() {
+	width := flag.Float64("width", 4000, "Room width in mm")
+	height := flag.Float64("height", 3000, "Room height in mm")
+	startX := flag.Float64("x", -1, "Starting X position in mm (default: room centre)")
+	startY := flag.Float64("y", -1, "Starting Y position in mm (default: room centre)")
+	heading := flag.Float64("heading", 0, "Starting heading in degrees, 0 points along +X")
+	charge := flag.Float64("battery", 90, "Starting battery charge in percent")
+	flag.Parse()
+
+	room := RoomConfig{
+		Width:        *width,
+		Height:       *height,
+		StartX:       *startX,
+		StartY:       *startY,
+		StartHeading: *heading,
+		StartCharge:  *charge,
+	}
+	if room.StartX < 0 {
+		room.StartX = room.Width / 2
+	}
+	if room.StartY < 0 {
+		room.StartY = room.Height / 2
+	}
+	if room.StartCharge < 0 || room.StartCharge > 100 {
+		log.Fatalf("Battery charge must be between 0 and 100 percent")
+	}
+	if room.Width < 2*robotRadius || room.Height < 2*robotRadius {
+		log.Fatalf("Room must be at least %.0f mm on each side", 2*robotRadius)
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		log.Fatalf("Failed to create pty: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	sim := NewSimulator(room)
+
+	fmt.Printf("Roomba simulator listening on %s\n", slave.Name())
+	fmt.Printf("Run: jrkbr %s\n", slave.Name())
+	log.Printf("Room %.0fx%.0f mm, starting at (%.0f, %.0f)", room.Width, room.Height, room.StartX, room.StartY)
+
+	// Advance the physics on a fixed tick
+	go func() {
+		ticker := time.NewTicker(stepInterval)
+		defer ticker.Stop()
+
+		lastReport := time.Now()
+		for range ticker.C {
+			sim.Step(stepInterval)
+
+			// Report the pose once a second while moving
+			if sim.Moving() && time.Since(lastReport) > time.Second {
+				x, y, h := sim.Pose()
+				log.Printf("Pose x=%.0f y=%.0f heading=%.1f", x, y, h)
+				lastReport = time.Now()
+			}
+		}
+	}()
+
+	// Answer commands from the client
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := master.Read(buf)
+			if err != nil {
+				log.Fatalf("Error reading from pty: %v", err)
+			}
+
+			if reply := sim.Feed(buf[:n]); len(reply) > 0 {
+				if _, err := master.Write(reply); err != nil {
+					log.Printf("Error writing to pty: %v", err)
+				}
+			}
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	for sig := range sigCh {
+		if sig == syscall.SIGUSR1 {
+			sim.SafetyFallback()
+			continue
+		}
+		break
+	}
+	fmt.Println("\nShutting down...")
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// SCI opcodes understood by the simulator
+const (
+	opStart       byte = 128
+	opBaud        byte = 129
+	opControl     byte = 130
+	opSafe        byte = 131
+	opFull        byte = 132
+	opPower       byte = 133
+	opSpot        byte = 134
+	opClean       byte = 135
+	opMax         byte = 136
+	opDrive       byte = 137
+	opMotors      byte = 138
+	opLeds        byte = 139
+	opSong        byte = 140
+	opPlay        byte = 141
+	opSensors     byte = 142
+	opDock        byte = 143
+	opDirect      byte = 145
+	opPWM         byte = 146
+	opStream      byte = 148
+	opQueryList   byte = 149
+	opPauseResume byte = 150
+)
+
+// Physical constants of the simulated robot
+const (
+	wheelBase        = 258.0 // Distance between the wheels in mm
+	robotRadius      = 170.0 // Radius of the round body in mm
+	straightRadius   = 32767
+	straightRadiusSC = -32768 // 0x8000, also treated as straight
+	maxWheelSpeed    = 500.0
+	batteryCapacity  = 2696 // mAh
+	idleCurrent      = -180 // mA
+	drivingCurrent   = -900 // mA
+)
+
+// OIMode is the operating mode of the simulated robot
+type OIMode byte
+
+const (
+	ModeOff     OIMode = 0
+	ModePassive OIMode = 1
+	ModeSafe    OIMode = 2
+	ModeFull    OIMode = 3
+)
+
+// String returns the mode name
+func (m OIMode) String() string {
+	switch m {
+	case ModeOff:
+		return "off"
+	case ModePassive:
+		return "passive"
+	case ModeSafe:
+		return "safe"
+	case ModeFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// RoomConfig describes the rectangular room the robot drives in
+type RoomConfig struct {
+	Width        float64 // mm along X
+	Height       float64 // mm along Y
+	StartX       float64 // Starting position in mm
+	StartY       float64
+	StartHeading float64 // Starting heading in degrees, 0 points along +X
+	StartCharge  float64 // Starting battery charge in percent of capacity
+}
+
+// Simulator emulates a Roomba answering SCI commands
+type Simulator struct {
+	mu   sync.Mutex
+	room RoomConfig
+	mode OIMode
+
+	// Wheel velocities in mm/s, positive forward
+	leftVel  float64
+	rightVel float64
+
+	// Pose in mm and radians
+	x       float64
+	y       float64
+	heading float64
+
+	// Odometry accumulated since the last sensor query
+	distance float64
+	angle    float64
+
+	bumpLeft  bool
+	bumpRight bool
+
+	charge  float64 // mAh
+	current int16   // mA
+
+	motors byte
+	leds   [3]byte
+	songs  map[byte][]byte
+
+	pending []byte // Bytes received but not yet forming a complete command
+}
+
+// NewSimulator creates a simulator sitting in the given room
+func NewSimulator(room RoomConfig) *Simulator {
+	return &Simulator{
+		room:    room,
+		mode:    ModeOff,
+		x:       room.StartX,
+		y:       room.StartY,
+		heading: room.StartHeading * math.Pi / 180,
+		charge:  batteryCapacity * room.StartCharge / 100,
+		current: idleCurrent,
+		songs:   make(map[byte][]byte),
+	}
+}
+
+// Feed consumes bytes received from the client and returns any reply bytes
+func (s *Simulator) Feed(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, data...)
+
+	var reply []byte
+	for len(s.pending) > 0 {
+		length := commandLength(s.pending)
+		if length < 0 || len(s.pending) < length {
+			// Wait for the rest of the command
+			break
+		}
+
+		frame := s.pending[:length]
+		reply = append(reply, s.handle(frame)...)
+		s.pending = s.pending[length:]
+	}
+
+	return reply
+}
+
+// commandLength returns the full length of the command at the start of buf,
+// or -1 if more bytes are needed to tell
+func commandLength(buf []byte) int {
+	switch buf[0] {
+	case opStart, opControl, opSafe, opFull, opPower, opSpot, opClean, opMax, opDock:
+		return 1
+	case opBaud, opMotors, opPlay, opSensors, opPauseResume:
+		return 2
+	case opLeds:
+		return 4
+	case opDrive, opDirect, opPWM:
+		return 5
+	case opSong:
+		if len(buf) < 3 {
+			return -1
+		}
+		return 3 + 2*int(buf[2])
+	case opStream, opQueryList:
+		if len(buf) < 2 {
+			return -1
+		}
+		return 2 + int(buf[1])
+	default:
+		// Unknown byte, skip it
+		return 1
+	}
+}
+
+// handle executes a single complete command
+func (s *Simulator) handle(frame []byte) []byte {
+	switch frame[0] {
+	case opStart:
+		s.setMode(ModePassive)
+	case opControl, opSafe:
+		s.setMode(ModeSafe)
+	case opFull:
+		s.setMode(ModeFull)
+	case opPower:
+		s.stopWheels()
+		s.setMode(ModeOff)
+	case opSpot, opClean, opMax, opDock:
+		// Cleaning and docking hand control back to the robot
+		s.stopWheels()
+		s.setMode(ModePassive)
+		log.Printf("Cleaning/dock command %d received", frame[0])
+	case opBaud:
+		log.Printf("Baud change to code %d ignored on a pty", frame[1])
+	case opDrive:
+		if s.canDrive() {
+			s.drive(int16(uint16(frame[1])<<8|uint16(frame[2])), int16(uint16(frame[3])<<8|uint16(frame[4])))
+		}
+	case opDirect:
+		if s.canDrive() {
+			right := int16(uint16(frame[1])<<8 | uint16(frame[2]))
+			left := int16(uint16(frame[3])<<8 | uint16(frame[4]))
+			s.setWheels(float64(left), float64(right))
+		}
+	case opPWM:
+		if s.canDrive() {
+			// PWM is -255..255, scale to velocity
+			right := int16(uint16(frame[1])<<8 | uint16(frame[2]))
+			left := int16(uint16(frame[3])<<8 | uint16(frame[4]))
+			s.setWheels(float64(left)*maxWheelSpeed/255, float64(right)*maxWheelSpeed/255)
+		}
+	case opMotors:
+		if s.motors != frame[1] {
+			log.Printf("Motors set to %05b", frame[1])
+		}
+		s.motors = frame[1]
+	case opLeds:
+		copy(s.leds[:], frame[1:4])
+	case opSong:
+		s.songs[frame[1]] = append([]byte(nil), frame[3:]...)
+		log.Printf("Song %d defined with %d notes", frame[1], frame[2])
+	case opPlay:
+		log.Printf("Playing song %d", frame[1])
+	case opSensors:
+		return s.sensorPacket(frame[1])
+	case opQueryList:
+		var reply []byte
+		for _, id := range frame[2:] {
+			reply = append(reply, s.sensorPacket(id)...)
+		}
+		return reply
+	case opStream, opPauseResume:
+		log.Printf("Sensor streaming is not supported by the simulator")
+	}
+	return nil
+}
+
+// canDrive reports whether the current mode accepts actuator commands
+func (s *Simulator) canDrive() bool {
+	return s.mode == ModeSafe || s.mode == ModeFull
+}
+
+// setMode changes the OI mode and logs transitions
+func (s *Simulator) setMode(mode OIMode) {
+	if s.mode != mode {
+		log.Printf("Mode %s -> %s", s.mode, mode)
+	}
+	s.mode = mode
+}
+
+// SafetyFallback mimics safe mode reacting to a cliff: the wheels stop and the robot drops to passive.
+// Full mode ignores it like the real robot does.
+func (s *Simulator) SafetyFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mode != ModeSafe {
+		log.Printf("Safety fallback ignored in %s mode", s.mode)
+		return
+	}
+	s.stopWheels()
+	s.setMode(ModePassive)
+}
+
+// drive converts a velocity/radius Drive command to wheel velocities
+func (s *Simulator) drive(velocity, radius int16) {
+	v := float64(velocity)
+
+	switch radius {
+	case straightRadius, straightRadiusSC, 0:
+		// A zero radius is undefined on the real robot, treat it as straight
+		s.setWheels(v, v)
+	case -1:
+		// Spin clockwise in place
+		s.setWheels(v, -v)
+	case 1:
+		// Spin counter-clockwise in place
+		s.setWheels(-v, v)
+	default:
+		r := float64(radius)
+		s.setWheels(v*(r-wheelBase/2)/r, v*(r+wheelBase/2)/r)
+	}
+}
+
+// setWheels sets the wheel velocities, clamped to what the motors can do
+func (s *Simulator) setWheels(left, right float64) {
+	s.leftVel = math.Max(-maxWheelSpeed, math.Min(maxWheelSpeed, left))
+	s.rightVel = math.Max(-maxWheelSpeed, math.Min(maxWheelSpeed, right))
+}
+
+// stopWheels stops both wheels
+func (s *Simulator) stopWheels() {
+	s.leftVel = 0
+	s.rightVel = 0
+}
+
+// Step advances the simulation by dt
+func (s *Simulator) Step(dt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seconds := dt.Seconds()
+	left := s.leftVel * seconds
+	right := s.rightVel * seconds
+
+	// Differential drive kinematics
+	forward := (left + right) / 2
+	turn := (right - left) / wheelBase
+
+	newHeading := s.heading + turn
+	newX := s.x + forward*math.Cos(s.heading+turn/2)
+	newY := s.y + forward*math.Sin(s.heading+turn/2)
+
+	// Rotation in place is always allowed, translation stops against the walls
+	if !s.insideRoom(newX, newY) {
+		clampedX, clampedY := s.clampToRoom(newX, newY)
+		forward *= math.Hypot(clampedX-s.x, clampedY-s.y) / math.Max(math.Abs(forward), 1e-9)
+		newX, newY = clampedX, clampedY
+	}
+	s.x, s.y = newX, newY
+	s.distance += forward
+	s.heading = math.Mod(newHeading, 2*math.Pi)
+	s.angle += (right - left) / 2
+
+	s.updateBumps()
+
+	// Drain the battery based on whether the wheels are turning
+	s.current = idleCurrent
+	if s.leftVel != 0 || s.rightVel != 0 {
+		s.current = drivingCurrent
+	}
+	s.charge = math.Max(0, s.charge+float64(s.current)*seconds/3600)
+}
+
+// insideRoom reports whether the robot body fits at the given position
+func (s *Simulator) insideRoom(x, y float64) bool {
+	return x >= robotRadius && x <= s.room.Width-robotRadius &&
+		y >= robotRadius && y <= s.room.Height-robotRadius
+}
+
+// clampToRoom moves a position inside the room so the robot body touches the wall it hit
+func (s *Simulator) clampToRoom(x, y float64) (float64, float64) {
+	x = math.Max(robotRadius, math.Min(x, s.room.Width-robotRadius))
+	y = math.Max(robotRadius, math.Min(y, s.room.Height-robotRadius))
+	return x, y
+}
+
+// updateBumps presses the bumpers that touch a wall in front of the robot
+func (s *Simulator) updateBumps() {
+	const contact = 2.0 // mm from the wall that counts as touching
+
+	s.bumpLeft, s.bumpRight = false, false
+
+	// Direction from the robot centre to each touching wall
+	var walls []float64
+	if s.x-robotRadius <= contact {
+		walls = append(walls, math.Pi)
+	}
+	if s.room.Width-robotRadius-s.x <= contact {
+		walls = append(walls, 0)
+	}
+	if s.y-robotRadius <= contact {
+		walls = append(walls, -math.Pi/2)
+	}
+	if s.room.Height-robotRadius-s.y <= contact {
+		walls = append(walls, math.Pi/2)
+	}
+
+	for _, wall := range walls {
+		// Angle of the wall relative to the heading, positive to the left
+		rel := math.Remainder(wall-s.heading, 2*math.Pi)
+		if math.Abs(rel) >= math.Pi/2 {
+			// Wall is behind the bumper
+			continue
+		}
+		if rel > -math.Pi/9 {
+			s.bumpLeft = true
+		}
+		if rel < math.Pi/9 {
+			s.bumpRight = true
+		}
+	}
+}
+
+// sensorPacket builds the reply for a sensor packet and resets odometry when read
+func (s *Simulator) sensorPacket(id byte) []byte {
+	switch id {
+	case 0:
+		packet := append(s.physicalPacket(), s.controlsPacket()...)
+		return append(packet, s.batteryPacket()...)
+	case 1:
+		return s.physicalPacket()
+	case 2:
+		return s.controlsPacket()
+	case 3:
+		return s.batteryPacket()
+	case 35:
+		return []byte{byte(s.mode)}
+	default:
+		log.Printf("Sensor packet %d not supported by the simulator", id)
+		return nil
+	}
+}
+
+// physicalPacket encodes sensor packet 1
+func (s *Simulator) physicalPacket() []byte {
+	packet := make([]byte, 10)
+	if s.bumpRight {
+		packet[0] |= 0x01
+	}
+	if s.bumpLeft {
+		packet[0] |= 0x02
+	}
+	return packet
+}
+
+// controlsPacket encodes sensor packet 2 and clears the accumulated odometry
+func (s *Simulator) controlsPacket() []byte {
+	distance := clampInt16(s.distance)
+	angle := clampInt16(s.angle)
+
+	// Keep the fractional remainder so slow motion still adds up
+	s.distance -= float64(distance)
+	s.angle -= float64(angle)
+
+	return []byte{
+		255, // No remote command
+		0,   // No buttons pressed
+		byte(uint16(distance) >> 8), byte(uint16(distance)),
+		byte(uint16(angle) >> 8), byte(uint16(angle)),
+	}
+}
+
+// batteryPacket encodes sensor packet 3
+func (s *Simulator) batteryPacket() []byte {
+	const voltage = 16200 // mV
+	const temperature = 27
+
+	charge := uint16(s.charge)
+	capacity := uint16(batteryCapacity)
+	return []byte{
+		0, // Not charging
+		byte(voltage >> 8), byte(voltage & 0xFF),
+		byte(uint16(s.current) >> 8), byte(uint16(s.current)),
+		temperature,
+		byte(charge >> 8), byte(charge),
+		byte(capacity >> 8), byte(capacity),
+	}
+}
+
+// Pose returns the current position in mm and heading in degrees
+func (s *Simulator) Pose() (x, y, heading float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.x, s.y, s.heading * 180 / math.Pi
+}
+
+// Moving reports whether either wheel is turning
+func (s *Simulator) Moving() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leftVel != 0 || s.rightVel != 0
+}
+
+// clampInt16 truncates a value toward zero and clamps it to the int16 range
+func clampInt16(v float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Trunc(v))))
+}
@@ -14,6 +14,12 @@ func main() {
 	config := lib.DefaultColorDetectionConfig()
 	config.ShowWindow = true // Enable window display
 
+	// Read from a video file, image directory, stream or synthetic frames instead of the camera if given
+	if len(os.Args) > 1 {
+		config.Source = os.Args[1]
+		config.LoopSource = true
+	}
+
 	// Create the color detector
 	detector, err := lib.NewColorDetector(config)
 	if err != nil {
@@ -44,8 +50,13 @@ func main() {
 			fmt.Println("\nShutting down...")
 			running = false
 		case <-ticker.C:
-			position := detector.GetPosition()
-			fmt.Printf("Current position: %s\n", position)
+			detection := detector.GetDetection()
+			if detection.Found {
+				fmt.Printf("Current position: %s (offset %+.2f, %.1f%% of frame, confidence %.2f)\n",
+					detection.Position, detection.Offset, detection.Coverage*100, detection.Confidence)
+			} else {
+				fmt.Printf("Current position: %s\n", detection.Position)
+			}
 		default:
 			// Show the current frame in the window - runs in main thread
 			if detector.ShowCurrentFrame() {
@@ -5,9 +5,9 @@ go 1.24
 require (
 	go.bug.st/serial v1.6.4
 	gocv.io/x/gocv v0.41.0
+	golang.org/x/sys v0.19.0
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
-	golang.org/x/sys v0.19.0 // indirect
 )
@@ -1,61 +1,300 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"go.bug.st/serial"
-	"gocv.io/x/gocv"
 	"io/ioutil"
 	"jrkbr/lib"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var roomba *lib.Roomba
+var odometry *lib.Odometry
+var safety *lib.SafetySupervisor
+var modeMonitor *lib.ModeMonitor
+var battery *lib.BatteryMonitor
+var jukebox *lib.Jukebox
+var leds *lib.LEDIndicator
+
+// songs are the melodies loaded into the Roomba, most named after the cat's expressions in static/index.html
+var songs = map[string]string{
+	"happy":     "T160 C5:8 E5:8 G5:8 C6:4",
+	"sad":       "T80 E4:4 Eb4:4 D4:2",
+	"surprised": "T200 G4:16 G5:4.",
+	"wink":      "T180 E5:16 R:16 G5:8",
+	"dizzy":     "T240 C5:16 B4:16 Bb4:16 A4:16 Ab4:16 G4:4",
+	"arrive":    "T140 G5:8 E5:8 C5:8 E5:8 G5:4 C6:2", // Chime when arriving at a table
+}
 var activeTracker *lib.ColorTracker
 var trackerMutex sync.Mutex
 
+// config holds the settings from the defaults, config file and flags
+var config lib.Config
+
 func main() {
-	// Check command line arguments
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: jrkbr <serial_port>")
-		ports, err := serial.GetPortsList()
+	defaults := lib.DefaultConfig()
+	configPath := flag.String("config", "", "JSON config file, flags override its settings")
+	addr := flag.String("addr", defaults.Server.Address, "Address for the web server to listen on")
+	modeName := flag.String("mode", defaults.Serial.Mode, "OI mode to drive in: safe or full")
+	baud := flag.Int("baud", defaults.Serial.Baud, "Serial baud rate")
+	probeBaud := flag.Bool("probe-baud", defaults.Serial.ProbeBaud, "Try other common baud rates if the Roomba doesn't answer")
+	lease := flag.Duration("lease", defaults.Serial.MotionLease.Value(), "Stop the robot if motion commands are not renewed within this window, 0 to disable")
+	usbVID := flag.String("usb-vid", "", "USB vendor ID of the Roomba cable, used when no port is given")
+	usbPID := flag.String("usb-pid", "", "USB product ID of the Roomba cable, used when no port is given")
+	usbSerial := flag.String("usb-serial", "", "USB serial number of the Roomba cable, to pick one of several identical cables")
+	cameraID := flag.Int("camera", defaults.Camera.ID, "Camera index")
+	source := flag.String("source", "", "Video file, image directory, rtsp:// or http:// stream, or synthetic to use instead of the camera")
+	loop := flag.Bool("loop", false, "Replay a video file or image directory from the start when it ends")
+	showWindow := flag.Bool("show-window", defaults.Camera.ShowWindow, "Show the color detection window, needs a display")
+	recordDir := flag.String("record", "", "Record each tracking run's frames and decisions to a new directory under this one")
+	recordFormat := flag.String("record-format", defaults.Record.Format, "How to record frames: png, jpg or avi")
+	steering := flag.String("steering", defaults.Tracker.SteeringMode, "How to steer toward the color: bang-bang or pid")
+	detect := flag.String("detect", defaults.Detection.Mode, "What to look for: blob to seek the largest patch of the color, line to follow a line of tape")
+	replayColor := flag.String("color", "", "Color preset to replay with, the default color if not given")
+	flag.Usage = func() {
+		fmt.Println("Usage: jrkbr [-config jrkbr.json] [-mode safe|full] [-baud 115200] [-usb-vid 0403 -usb-pid 6015] [serial_port]")
+		fmt.Println("       jrkbr ports")
+		fmt.Println("       jrkbr [-config jrkbr.json] [-color lime] [-steering pid] replay <recording_dir>")
+		fmt.Println("Without a serial port the Roomba cable is found by its USB IDs, or by probing every port.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.Arg(0) == "ports" {
+		if err := printPorts(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Settings come from the defaults, then the config file, then any flags given
+	config = defaults
+	if *configPath != "" {
+		loaded, err := lib.LoadConfig(*configPath)
 		if err != nil {
-			log.Fatalf("Error getting serial ports: %v", err)
+			log.Fatalf("Invalid config: %v", err)
 		}
-		if len(ports) == 0 {
-			fmt.Println("No serial ports found!")
-		} else {
-			fmt.Println("Available serial ports:")
-			for _, port := range ports {
-				fmt.Println("  " + port)
-			}
+		config = loaded
+		log.Printf("Loaded config from %s", *configPath)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			config.Server.Address = *addr
+		case "mode":
+			config.Serial.Mode = *modeName
+		case "baud":
+			config.Serial.Baud = *baud
+		case "probe-baud":
+			config.Serial.ProbeBaud = *probeBaud
+		case "lease":
+			config.Serial.MotionLease = lib.Duration(lease.String())
+		case "usb-vid":
+			config.Serial.USBVID = *usbVID
+		case "usb-pid":
+			config.Serial.USBPID = *usbPID
+		case "usb-serial":
+			config.Serial.USBSerial = *usbSerial
+		case "camera":
+			config.Camera.ID = *cameraID
+		case "source":
+			config.Camera.Source = *source
+		case "loop":
+			config.Camera.Loop = *loop
+		case "show-window":
+			config.Camera.ShowWindow = *showWindow
+		case "record":
+			config.Record.Dir = *recordDir
+		case "record-format":
+			config.Record.Format = *recordFormat
+		case "steering":
+			config.Tracker.SteeringMode = *steering
+		case "detect":
+			config.Detection.Mode = *detect
+		}
+	})
+	if flag.NArg() > 0 && flag.Arg(0) != "replay" {
+		config.Serial.Port = flag.Arg(0)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(1)
 		}
-		os.Exit(1)
+		os.Exit(replay(flag.Arg(1), *replayColor))
+	}
+	mode, err := lib.ParseOIMode(config.Serial.Mode)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	// Use the configured port, otherwise go looking for the Roomba
+	portName := config.Serial.Port
+	if portName == "" {
+		match := lib.USBMatch{VID: config.Serial.USBVID, PID: config.Serial.USBPID, SerialNumber: config.Serial.USBSerial}
+		found, err := lib.DiscoverPort(match, config.Serial.Baud)
+		if err != nil {
+			log.Printf("Could not find the Roomba: %v", err)
+			flag.Usage()
+			printPorts()
+			os.Exit(1)
+		}
+		log.Printf("Found Roomba on %s", found)
+		portName = found
 	}
 
 	// Create a new Roomba instance
-	roomba = lib.NewRoomba(os.Args[1], 115200)
+	roomba = lib.NewRoomba(portName, config.Serial.Baud)
+	if config.Serial.ProbeBaud {
+		roomba.ProbeBaudRates = lib.DefaultProbeBaudRates
+	}
+	roomba.SetMotionLease(config.Serial.MotionLease.Value())
 
 	// Connect to the Roomba
 	if err := roomba.Connect(); err != nil {
 		log.Fatalf("Failed to connect to Roomba: %v", err)
 	}
-	log.Println("Connected to Roomba")
+	log.Printf("Connected to Roomba at %d baud", roomba.BaudRate())
 	defer roomba.Close()
 
+	// The port is reopened automatically if the cable glitches; drop tracking while it's gone
+	roomba.OnConnectionChange(func(state lib.ConnectionState) {
+		log.Printf("Roomba connection %s", state)
+		if state == lib.ConnConnected {
+			return
+		}
+
+		trackerMutex.Lock()
+		defer trackerMutex.Unlock()
+
+		if activeTracker != nil {
+			log.Println("Cancelling color tracking, lost connection to Roomba")
+			activeTracker.Stop()
+			activeTracker.Close()
+			activeTracker = nil
+		}
+	})
+
 	// Start the Roomba
 	if err := roomba.Start(); err != nil {
 		log.Fatalf("Failed to start Roomba: %v", err)
 	}
 	log.Println("Roomba started")
 
-	if err := roomba.FullMode(); err != nil {
-		log.Fatalf("Failed to set Roomba to full mode: %v", err)
+	if err := roomba.SetMode(mode); err != nil {
+		log.Fatalf("Failed to set Roomba to %s mode: %v", mode, err)
+	}
+	log.Printf("Roomba in %s mode", mode)
+
+	// Store the songs in alphabetical order so each gets the same slots every run
+	jukebox = lib.NewJukebox(roomba)
+	songNames := make([]string, 0, len(songs))
+	for name := range songs {
+		songNames = append(songNames, name)
+	}
+	sort.Strings(songNames)
+	for _, name := range songNames {
+		if err := jukebox.Load(name, songs[name]); err != nil {
+			log.Fatalf("Failed to load song: %v", err)
+		}
+	}
+	log.Printf("Loaded %d songs", len(songNames))
+
+	// Poll all sensor packets in the background so handlers can read the latest values
+	poller, err := roomba.StartSensorPolling(lib.SensorPacketAll, lib.DefaultSensorPollInterval)
+	if err != nil {
+		log.Fatalf("Failed to start sensor polling: %v", err)
+	}
+	log.Println("Sensor polling started")
+
+	// Track the robot's position from the distance and angle sensors
+	odometry = lib.NewOdometry(lib.DefaultOdometryConfig())
+	odometry.Start(poller)
+	defer odometry.Stop()
+
+	// Show what the robot is doing on its LEDs, so staff don't need to see the face screen
+	leds = lib.NewLEDIndicator(roomba, nil)
+	leds.Start()
+	defer leds.Stop()
+
+	// Stop on bumps, cliffs and wheel drops; full mode disables the Roomba's own cliff protection
+	safety = lib.NewSafetySupervisor(roomba, config.Safety)
+	safety.OnTrip(func(reason lib.TripReason) {
+		updateFault()
+
+		trackerMutex.Lock()
+		defer trackerMutex.Unlock()
+
+		if activeTracker != nil {
+			log.Printf("Cancelling color tracking after %s", reason)
+			activeTracker.Stop()
+			activeTracker.Close()
+			activeTracker = nil
+		}
+	})
+	if err := safety.Start(); err != nil {
+		log.Fatalf("Failed to start safety supervisor: %v", err)
+	}
+	defer safety.Stop()
+	log.Println("Safety supervisor started")
+
+	// Watch for the Roomba dropping out of the requested mode, e.g. to passive after a cliff in safe mode.
+	// It ignores drive commands until the operator confirms re-entering the mode via /mode/restore.
+	modeMonitor = lib.NewModeMonitor(roomba, lib.DefaultModePollInterval)
+	modeMonitor.OnFallback(func(fallback lib.ModeFallback) {
+		updateFault()
+
+		trackerMutex.Lock()
+		defer trackerMutex.Unlock()
+
+		if activeTracker != nil {
+			log.Printf("Cancelling color tracking, Roomba %s", fallback)
+			activeTracker.Stop()
+			activeTracker.Close()
+			activeTracker = nil
+		}
+	})
+	modeMonitor.Start()
+	defer modeMonitor.Stop()
+
+	// Keep an eye on the battery and head for the dock before it runs flat
+	battery, err = lib.NewBatteryMonitor(roomba, config.Battery)
+	if err != nil {
+		log.Fatalf("Invalid battery config: %v", err)
 	}
-	log.Println("Roomba in full mode")
+	battery.OnChange(func(event lib.BatteryEvent) {
+		updateFault()
+		if event.Level != lib.BatteryCritical {
+			return
+		}
+
+		trackerMutex.Lock()
+		defer trackerMutex.Unlock()
+
+		if activeTracker != nil {
+			log.Println("Cancelling color tracking, battery critical")
+			activeTracker.Stop()
+			activeTracker.Close()
+			activeTracker = nil
+		}
+	})
+	if err := battery.Start(); err != nil {
+		log.Fatalf("Failed to start battery monitor: %v", err)
+	}
+	defer battery.Stop()
+	log.Println("Battery monitor started")
 
 	// Create HTTP server
 	// Serve static files from the "static" directory
@@ -95,10 +334,21 @@ func main() {
 			return
 		}
 
-		// Get color to seek - default to lime if not specified
+		// Look up the color preset, the configured default if none is given
 		colorName := r.FormValue("color")
 		if colorName == "" {
-			colorName = "lime" // Default to lime
+			colorName = config.DefaultColor
+		}
+		trackerConfig, err := config.TrackerConfig(colorName)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Don't start a run the battery can't finish
+		if err := battery.CanStart(); err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusConflict)
+			return
 		}
 
 		log.Printf("Seeking color: %s", colorName)
@@ -109,37 +359,12 @@ func main() {
 		// Clean up any existing tracker
 		if activeTracker != nil {
 			activeTracker.Stop()
+			activeTracker.Close()
 			activeTracker = nil
 		}
 
-		// Create color tracker config
-		config := lib.DefaultColorTrackerConfig()
-
-		// Set color range based on requested color
-		switch colorName {
-		case "red":
-			// Red is special in HSV as it wraps around
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(0, 100, 100, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(10, 255, 255, 0)
-		case "blue":
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(100, 100, 100, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(130, 255, 255, 0)
-		case "yellow":
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(20, 100, 100, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(30, 255, 255, 0)
-		case "black":
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(0, 0, 0, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(180, 255, 50, 0)
-		case "lime":
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(45, 100, 100, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(65, 255, 255, 0)
-		default: // Green
-			config.DetectorConfig.LowerHSVBound = gocv.NewScalar(35, 100, 100, 0)
-			config.DetectorConfig.UpperHSVBound = gocv.NewScalar(50, 255, 255, 0)
-		}
-
 		// Create the color tracker
-		tracker, err := lib.NewColorTracker(config, roomba)
+		tracker, err := lib.NewColorTracker(trackerConfig, roomba)
 		if err != nil {
 			log.Printf("Error creating color tracker: %v", err)
 			trackerMutex.Unlock()
@@ -148,6 +373,13 @@ func main() {
 		}
 
 		// Store the active tracker
+		tracker.OnStateChange(leds.SetState)
+		tracker.OnLineEnd(func() {
+			// Let the table know the food is here
+			if err := jukebox.Play("arrive"); err != nil {
+				log.Printf("Error playing arrival chime: %v", err)
+			}
+		})
 		activeTracker = tracker
 		trackerMutex.Unlock()
 
@@ -179,6 +411,31 @@ func main() {
 		fmt.Fprint(w, "Stopped")
 	})
 
+	// Detection handler reports what the tracker's camera sees, so the UI can show how far off-center the color is
+	http.HandleFunc("/detection", func(w http.ResponseWriter, r *http.Request) {
+		response := struct {
+			lib.DetectionResult
+			State string
+		}{
+			DetectionResult: lib.DetectionResult{Position: lib.LineNotFound},
+			State:           lib.StateIdle.String(),
+		}
+
+		trackerMutex.Lock()
+		if activeTracker != nil {
+			response.State = activeTracker.State().String()
+			if detector := activeTracker.GetColorDetector(); detector != nil && activeTracker.State() != lib.StateIdle {
+				response.DetectionResult = detector.GetDetection()
+			}
+		}
+		trackerMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
 	// Movement handler for manual control
 	http.HandleFunc("/move", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -229,10 +486,10 @@ func main() {
 			err = roomba.Drive(-speed, lib.StraightRadius)
 			response = fmt.Sprintf("Moving backward at speed %d", speed)
 		case "left":
-			err = roomba.Drive(speed, 1) // Counter-clockwise turn
+			err = roomba.Spin(speed) // Counter-clockwise turn
 			response = fmt.Sprintf("Turning left at speed %d", speed)
 		case "right":
-			err = roomba.Drive(speed, -1) // Clockwise turn
+			err = roomba.Spin(-speed) // Clockwise turn
 			response = fmt.Sprintf("Turning right at speed %d", speed)
 		case "stop":
 			err = roomba.Stop()
@@ -252,11 +509,368 @@ func main() {
 		fmt.Fprint(w, response)
 	})
 
+	// Heartbeat handler keeps a manual movement going while the operator holds the button
+	http.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		roomba.Heartbeat()
+		fmt.Fprint(w, "OK")
+	})
+
+	// Closed-loop movement handler drives a set distance or turns a set angle.
+	// The request blocks until the move finishes; closing it stops the robot.
+	http.HandleFunc("/moveBy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse form data
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+			return
+		}
+
+		var speed int16 = 150 // Default speed
+		if speedStr := r.FormValue("speed"); speedStr != "" {
+			speedInt, err := strconv.Atoi(speedStr)
+			if err != nil || speedInt <= 0 || speedInt > int(lib.MaxVelocity) {
+				http.Error(w, "Invalid speed", http.StatusBadRequest)
+				return
+			}
+			speed = int16(speedInt)
+		}
+
+		// Stop any active color tracking
+		trackerMutex.Lock()
+		if activeTracker != nil {
+			activeTracker.Stop()
+			activeTracker.Close()
+			activeTracker = nil
+		}
+		trackerMutex.Unlock()
+
+		var response string
+		if distanceStr := r.FormValue("distance"); distanceStr != "" {
+			distance, convErr := strconv.Atoi(distanceStr)
+			if convErr != nil {
+				http.Error(w, "Invalid distance", http.StatusBadRequest)
+				return
+			}
+			err = roomba.DriveDistance(r.Context(), distance, speed)
+			response = fmt.Sprintf("Drove %d mm", distance)
+		} else if angleStr := r.FormValue("angle"); angleStr != "" {
+			angle, convErr := strconv.ParseFloat(angleStr, 64)
+			if convErr != nil {
+				http.Error(w, "Invalid angle", http.StatusBadRequest)
+				return
+			}
+			err = roomba.RotateBy(r.Context(), angle, speed)
+			response = fmt.Sprintf("Rotated %.1f degrees", angle)
+		} else {
+			http.Error(w, "Missing distance or angle", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error controlling Roomba: %v", err)
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Println(response)
+		fmt.Fprint(w, response)
+	})
+
+	// Sensor handler reports the latest sensor readings as JSON
+	http.HandleFunc("/sensors", func(w http.ResponseWriter, r *http.Request) {
+		poller := roomba.Poller()
+		if poller == nil {
+			http.Error(w, "Sensor polling not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		data, ok := poller.Latest()
+		if !ok {
+			http.Error(w, "No sensor data yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Pose handler reports the odometry pose and the path driven since the last reset
+	http.HandleFunc("/pose", func(w http.ResponseWriter, r *http.Request) {
+		pose := odometry.Pose()
+		response := struct {
+			X              float64
+			Y              float64
+			HeadingDegrees float64
+			Traveled       float64
+			Path           []lib.Pose
+		}{
+			X:              pose.X,
+			Y:              pose.Y,
+			HeadingDegrees: pose.HeadingDegrees(),
+			Traveled:       odometry.Traveled(),
+			Path:           odometry.Path(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Pose reset handler makes the current position the new origin
+	http.HandleFunc("/pose/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		odometry.Reset()
+		fmt.Fprint(w, "Pose reset")
+	})
+
+	// Safety handler reports whether the interlock is engaged and why
+	http.HandleFunc("/safety", func(w http.ResponseWriter, r *http.Request) {
+		reason, tripped := safety.Tripped()
+		response := struct {
+			Tripped bool
+			Reason  string
+			Time    time.Time
+		}{
+			Tripped: tripped,
+		}
+		if tripped {
+			response.Reason = reason.String()
+			response.Time = reason.Time
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Safety reset handler releases the interlock once the hazard has been cleared
+	http.HandleFunc("/safety/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := safety.Reset(); err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusConflict)
+			return
+		}
+		updateFault()
+		fmt.Fprint(w, "Safety interlock reset")
+	})
+
+	// Battery handler reports the state of charge and battery readings as JSON
+	http.HandleFunc("/battery", func(w http.ResponseWriter, r *http.Request) {
+		status, ok := battery.Status()
+		if !ok {
+			http.Error(w, "No battery data yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		response := struct {
+			lib.BatteryStatus
+			Level         string
+			ChargingState string
+			CanStart      bool
+		}{
+			BatteryStatus: status,
+			Level:         status.Level.String(),
+			ChargingState: status.ChargingState.String(),
+			CanStart:      battery.CanStart() == nil,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Song handler lists the songs on GET and plays one on POST
+	http.HandleFunc("/song", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(jukebox.Names()); err != nil {
+				log.Printf("Error writing response: %v", err)
+			}
+		case http.MethodPost:
+			name := r.FormValue("name")
+			err := jukebox.Play(name)
+			switch {
+			case errors.Is(err, lib.ErrUnknownSong):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, lib.ErrSongPlaying):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case err != nil:
+				log.Printf("Error playing song: %v", err)
+				http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			default:
+				fmt.Fprintf(w, "Playing %s", name)
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Connection handler reports the state of the link to the Roomba
+	http.HandleFunc("/connection", func(w http.ResponseWriter, r *http.Request) {
+		response := struct {
+			State    string
+			Port     string
+			BaudRate int
+		}{
+			State:    roomba.ConnectionState().String(),
+			Port:     roomba.PortName(),
+			BaudRate: roomba.BaudRate(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Mode handler reports the OI mode on GET and switches between safe and full mode on POST
+	http.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			mode, err := lib.ParseOIMode(r.FormValue("mode"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := roomba.SetMode(mode); err != nil {
+				log.Printf("Error changing mode: %v", err)
+				http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Roomba in %s mode", mode)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fallback, fellBack := modeMonitor.Fallback()
+		response := struct {
+			Mode      string
+			Requested string
+			FellBack  bool
+			Fallback  string
+		}{
+			Mode:      roomba.Mode().String(),
+			Requested: roomba.RequestedMode().String(),
+			FellBack:  fellBack,
+		}
+		if fellBack {
+			response.Fallback = fallback.String()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+
+	// Mode restore handler re-enters the requested mode after the Roomba dropped out of it
+	http.HandleFunc("/mode/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if _, fellBack := modeMonitor.Fallback(); !fellBack {
+			fmt.Fprintf(w, "Roomba already in %s mode", roomba.RequestedMode())
+			return
+		}
+		if err := modeMonitor.Restore(); err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		updateFault()
+		fmt.Fprintf(w, "Roomba back in %s mode", roomba.RequestedMode())
+	})
+
 	// Start the HTTP server
-	port := 8080
-	log.Printf("Starting server on port %d...", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	log.Printf("Starting server on %s...", config.Server.Address)
+	err = http.ListenAndServe(config.Server.Address, nil)
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// updateFault flashes the error pattern on the LEDs while the safety interlock is engaged,
+// the Roomba has dropped out of the requested mode or the battery is critical
+func updateFault() {
+	fault := false
+	if safety != nil {
+		_, tripped := safety.Tripped()
+		fault = fault || tripped
+	}
+	if modeMonitor != nil {
+		_, fellBack := modeMonitor.Fallback()
+		fault = fault || fellBack
+	}
+	if battery != nil {
+		status, ok := battery.Status()
+		fault = fault || (ok && status.Level == lib.BatteryCritical)
+	}
+	leds.SetFault(fault)
+}
+
+// printPorts lists the serial ports with their USB details, to find the IDs of the Roomba cable
+func printPorts() error {
+	ports, err := lib.ListPorts()
+	if err != nil {
+		return err
+	}
+
+	if len(ports) == 0 {
+		fmt.Println("No serial ports found!")
+		return nil
+	}
+	fmt.Println("Available serial ports:")
+	for _, port := range ports {
+		fmt.Println("  " + port.String())
+	}
+	return nil
+}
+
+// replay runs a recording through the current settings and prints where the decisions changed.
+// It returns the exit code: 0 if nothing changed, 1 if something did or the replay failed.
+func replay(dir, colorName string) int {
+	trackerConfig, err := config.TrackerConfig(colorName)
+	if err != nil {
+		log.Printf("Invalid -color: %v", err)
+		return 1
+	}
+
+	report, err := lib.ReplayRecording(dir, trackerConfig)
+	if err != nil {
+		log.Printf("Replay failed: %v", err)
+		return 1
+	}
+
+	fmt.Print(report)
+	if len(report.Diffs) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// batteryBufferSize is how many readings the battery monitor can fall behind before dropping old ones
+const batteryBufferSize = 4
+
+// ErrBatteryLow is returned when the battery is too low to start a new run
+var ErrBatteryLow = errors.New("battery too low")
+
+// StateOfCharge returns the remaining charge in percent of capacity.
+// It returns false if the reading has no battery data.
+func (sd SensorData) StateOfCharge() (float64, bool) {
+	if sd.PacketID != SensorPacketAll && sd.PacketID != SensorPacketBattery {
+		return 0, false
+	}
+	if sd.Capacity == 0 {
+		return 0, false
+	}
+	return 100 * float64(sd.Charge) / float64(sd.Capacity), true
+}
+
+// Charging reports whether the Roomba is on its charger
+func (cs ChargingState) Charging() bool {
+	return cs == ChargingStateRecovery || cs == ChargingStateCharging || cs == ChargingStateTrickle
+}
+
+// BatteryLevel is a coarse classification of the state of charge
+type BatteryLevel int
+
+const (
+	BatteryUnknown  BatteryLevel = iota // No battery reading yet
+	BatteryOK                           // Enough charge for normal operation
+	BatteryLow                          // Below the low threshold
+	BatteryCritical                     // Below the critical threshold, time to dock
+)
+
+// String returns the level name
+func (bl BatteryLevel) String() string {
+	switch bl {
+	case BatteryUnknown:
+		return "unknown"
+	case BatteryOK:
+		return "ok"
+	case BatteryLow:
+		return "low"
+	case BatteryCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(bl))
+	}
+}
+
+// BatteryConfig holds the thresholds for the battery monitor, all in percent of capacity
+type BatteryConfig struct {
+	LowPercent      float64 `json:"low_percent"`       // Below this the battery is low
+	CriticalPercent float64 `json:"critical_percent"`  // Below this the battery is critical
+	MinStartPercent float64 `json:"min_start_percent"` // New runs are refused below this
+	Hysteresis      float64 `json:"hysteresis"`        // How far above a threshold the charge must rise to leave a level
+	AutoDock        bool    `json:"auto_dock"`         // Send the robot to its dock when the battery turns critical
+}
+
+// DefaultBatteryConfig returns reasonable default settings
+func DefaultBatteryConfig() BatteryConfig {
+	return BatteryConfig{
+		LowPercent:      25,
+		CriticalPercent: 10,
+		MinStartPercent: 20, // Leave enough charge to finish a run and get back
+		Hysteresis:      2,  // Keep the level from flapping as the voltage sags under load
+		AutoDock:        true,
+	}
+}
+
+// BatteryStatus is a snapshot of the battery readings
+type BatteryStatus struct {
+	Percent       float64       // State of charge
+	Level         BatteryLevel  // Classification of Percent
+	ChargingState ChargingState // Charging state reported by the Roomba
+	Voltage       uint16        // mV
+	Current       int16         // mA, negative when discharging
+	Temperature   int8          // Degrees C
+	Charge        uint16        // mAh
+	Capacity      uint16        // mAh
+	Timestamp     time.Time     // When the reading was taken
+}
+
+// BatteryEvent is emitted when the battery level changes
+type BatteryEvent struct {
+	Previous BatteryLevel
+	Level    BatteryLevel
+	Status   BatteryStatus
+}
+
+// BatteryMonitor tracks the state of charge from the sensor poller, emits an event whenever
+// the battery level changes and sends the robot to its dock when the battery turns critical
+type BatteryMonitor struct {
+	config    BatteryConfig
+	roomba    *Roomba
+	poller    *SensorPoller
+	readings  <-chan SensorData
+	status    BatteryStatus
+	hasStatus bool
+	onChange  []func(BatteryEvent)
+	running   bool
+	mu        sync.RWMutex
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+}
+
+// NewBatteryMonitor creates a battery monitor for the given Roomba
+func NewBatteryMonitor(roomba *Roomba, config BatteryConfig) (*BatteryMonitor, error) {
+	if config.CriticalPercent < 0 || config.CriticalPercent >= config.LowPercent || config.LowPercent > 100 {
+		return nil, fmt.Errorf("battery thresholds must satisfy 0 <= critical (%.0f) < low (%.0f) <= 100",
+			config.CriticalPercent, config.LowPercent)
+	}
+	if config.Hysteresis < 0 {
+		return nil, fmt.Errorf("battery hysteresis must not be negative, got %.1f", config.Hysteresis)
+	}
+
+	return &BatteryMonitor{
+		config: config,
+		roomba: roomba,
+	}, nil
+}
+
+// OnChange registers a callback run whenever the battery level changes
+func (bm *BatteryMonitor) OnChange(callback func(BatteryEvent)) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.onChange = append(bm.onChange, callback)
+}
+
+// Start begins watching the Roomba's sensor poller
+func (bm *BatteryMonitor) Start() error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if bm.running {
+		return nil
+	}
+
+	// Battery readings are in packet 3, which group 0 includes
+	poller := bm.roomba.Poller()
+	if poller == nil || (poller.PacketID() != SensorPacketAll && poller.PacketID() != SensorPacketBattery) {
+		return ErrNoSensorFeedback
+	}
+
+	bm.running = true
+	bm.poller = poller
+	bm.readings = poller.SubscribeBuffered(batteryBufferSize)
+	bm.stopChan = make(chan struct{})
+	bm.doneChan = make(chan struct{})
+
+	go bm.watchLoop(bm.readings, bm.stopChan, bm.doneChan)
+	return nil
+}
+
+// Stop stops watching the battery
+func (bm *BatteryMonitor) Stop() {
+	bm.mu.Lock()
+	if !bm.running {
+		bm.mu.Unlock()
+		return
+	}
+	bm.running = false
+	close(bm.stopChan)
+	done := bm.doneChan
+	bm.poller.Unsubscribe(bm.readings)
+	bm.mu.Unlock()
+
+	<-done
+}
+
+// Status returns the latest battery status and whether a reading has been received yet
+func (bm *BatteryMonitor) Status() (BatteryStatus, bool) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.status, bm.hasStatus
+}
+
+// CanStart returns ErrBatteryLow if the charge is below the floor for starting a new run
+func (bm *BatteryMonitor) CanStart() error {
+	status, ok := bm.Status()
+	if !ok {
+		return fmt.Errorf("%w: no battery reading yet", ErrBatteryLow)
+	}
+	if status.Percent < bm.config.MinStartPercent {
+		return fmt.Errorf("%w: %.0f%% charge, need %.0f%%", ErrBatteryLow, status.Percent, bm.config.MinStartPercent)
+	}
+	return nil
+}
+
+// watchLoop updates the status from every battery reading
+func (bm *BatteryMonitor) watchLoop(readings <-chan SensorData, stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case data, ok := <-readings:
+			if !ok {
+				return
+			}
+			bm.update(data)
+		}
+	}
+}
+
+// update records a reading and reacts to a change of level
+func (bm *BatteryMonitor) update(data SensorData) {
+	percent, ok := data.StateOfCharge()
+	if !ok {
+		return
+	}
+
+	bm.mu.Lock()
+	previous := bm.status.Level
+	status := BatteryStatus{
+		Percent:       percent,
+		Level:         bm.classify(percent, previous),
+		ChargingState: data.ChargingState,
+		Voltage:       data.Voltage,
+		Current:       data.Current,
+		Temperature:   data.Temperature,
+		Charge:        data.Charge,
+		Capacity:      data.Capacity,
+		Timestamp:     data.Timestamp,
+	}
+	bm.status = status
+	bm.hasStatus = true
+	callbacks := append(([]func(BatteryEvent))(nil), bm.onChange...)
+	bm.mu.Unlock()
+
+	if status.Level == previous {
+		return
+	}
+
+	log.Printf("Battery %s at %.0f%%", status.Level, status.Percent)
+	event := BatteryEvent{Previous: previous, Level: status.Level, Status: status}
+	for _, callback := range callbacks {
+		callback(event)
+	}
+
+	// Head home before the robot dies where it stands, unless it is already charging
+	if status.Level == BatteryCritical && bm.config.AutoDock && !status.ChargingState.Charging() {
+		// Driving off to the dock could take the robot over the cliff or into whatever it hit
+		if reason, tripped := bm.roomba.Interlock(); tripped {
+			log.Printf("Battery critical - Not seeking dock while the safety interlock is engaged (%s)", reason)
+			return
+		}
+		log.Println("Battery critical - Seeking dock")
+		if err := bm.roomba.Stop(); err != nil {
+			log.Printf("Error stopping Roomba before docking: %v", err)
+		}
+		if err := bm.roomba.Dock(); err != nil {
+			log.Printf("Error sending Roomba to dock: %v", err)
+		}
+	}
+}
+
+// classify maps a state of charge to a level, requiring the charge to rise
+// past the hysteresis band before leaving the current level upwards
+func (bm *BatteryMonitor) classify(percent float64, current BatteryLevel) BatteryLevel {
+	critical := bm.config.CriticalPercent
+	low := bm.config.LowPercent
+	if current == BatteryCritical {
+		critical += bm.config.Hysteresis
+	}
+	if current == BatteryCritical || current == BatteryLow {
+		low += bm.config.Hysteresis
+	}
+
+	switch {
+	case percent < critical:
+		return BatteryCritical
+	case percent < low:
+		return BatteryLow
+	default:
+		return BatteryOK
+	}
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultProbeBaudRates are worth trying when the rate is unknown: the Open Interface
+// default, the SCI default and a slow rate some USB adapters need to be stable
+var DefaultProbeBaudRates = []int{115200, 57600, 19200}
+
+// Plausible battery voltage range in mV, from a flat pack to one on the charger
+const (
+	minPlausibleVoltage = 8000
+	maxPlausibleVoltage = 22000
+)
+
+// BaudRate returns the baud rate the port is open at, the detected one after probing
+func (r *Roomba) BaudRate() int {
+	r.writerMu.Lock()
+	defer r.writerMu.Unlock()
+	return r.baudRate
+}
+
+// SwitchBaud tells the Roomba to change its baud rate, then reopens the port at the new rate.
+// Only ports opened by Connect can be reopened.
+func (r *Roomba) SwitchBaud(rate int) error {
+	if err := r.canReopen(); err != nil {
+		return err
+	}
+	if rate == r.BaudRate() {
+		return nil
+	}
+
+	if err := r.Baud(rate); err != nil {
+		return err
+	}
+
+	// Baud returns once the opcode is written and reopening stops the writer before it paces the
+	// next command, so wait out the delay the Roomba needs before it listens at the new rate here
+	time.Sleep(baudChangeDelay)
+	if err := r.reopen(rate); err != nil {
+		return err
+	}
+
+	log.Printf("Switched to %d baud", rate)
+	return nil
+}
+
+// probeBaudRate tries the configured rate, then each of ProbeBaudRates, until the Roomba
+// answers a sensor query sensibly. It leaves the port open at the rate that worked.
+func (r *Roomba) probeBaudRate() error {
+	rates := []int{r.BaudRate()}
+	for _, rate := range r.ProbeBaudRates {
+		if rate != rates[0] {
+			rates = append(rates, rate)
+		}
+	}
+
+	// Transports passed in can't be reopened, so only their current rate can be checked
+	if err := r.canReopen(); err != nil {
+		rates = rates[:1]
+	}
+
+	var lastErr error
+	for i, rate := range rates {
+		if i > 0 {
+			if err := r.reopen(rate); err != nil {
+				return err
+			}
+		}
+
+		lastErr = r.checkResponds()
+		if lastErr == nil {
+			return nil
+		}
+		if len(rates) > 1 {
+			log.Printf("No valid reply at %d baud: %v", rate, lastErr)
+		}
+	}
+
+	if len(rates) == 1 {
+		return fmt.Errorf("no valid reply from the Roomba: %v", lastErr)
+	}
+	return fmt.Errorf("no valid reply from the Roomba at any of %v baud", rates)
+}
+
+// checkResponds sends Start and a battery query and checks the reply makes sense.
+// At the wrong baud rate the reply is missing, short or garbled.
+func (r *Roomba) checkResponds() error {
+	if err := r.Start(); err != nil {
+		return err
+	}
+
+	data, err := r.Sensors(SensorPacketBattery)
+	if err != nil {
+		return err
+	}
+	if data.ChargingState > ChargingStateError {
+		return fmt.Errorf("implausible charging state %d", data.ChargingState)
+	}
+	if data.Voltage < minPlausibleVoltage || data.Voltage > maxPlausibleVoltage {
+		return fmt.Errorf("implausible battery voltage %d mV", data.Voltage)
+	}
+	return nil
+}
+
+// canReopen returns an error unless the port was opened by Connect and its rate can be changed
+func (r *Roomba) canReopen() error {
+	name := r.PortName()
+	if name == "" {
+		return fmt.Errorf("cannot change the baud rate of a transport that was passed in")
+	}
+	if strings.HasPrefix(name, tcpPrefix) {
+		return fmt.Errorf("cannot change the baud rate of a serial bridge at %s", name)
+	}
+	return nil
+}
+
+// reopen closes the port and opens it again at the given rate, restarting the writer
+func (r *Roomba) reopen(rate int) error {
+	r.stopWriter()
+	if r.port != nil {
+		r.port.Close()
+		r.port = nil
+	}
+
+	port, err := OpenTransport(r.PortName(), rate)
+	if err != nil {
+		return err
+	}
+	r.port = port
+	if err := r.configurePort(); err != nil {
+		return err
+	}
+
+	r.writerMu.Lock()
+	r.baudRate = rate
+	r.writerMu.Unlock()
+
+	r.startWriter()
+	return nil
+}
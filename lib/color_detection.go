@@ -1,8 +1,13 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"log"
+	"math"
+	"strconv"
 	"sync"
 	"time"
 
@@ -28,7 +33,11 @@ type ColorDetectionConfig struct {
 	ShowWindow      bool
 	WindowName      string
 	CameraID        int
+	Source          string // Frame source for OpenFrameSource, e.g. a video file; empty opens CameraID
+	LoopSource      bool   // Replay a file or directory source from the start when it ends
 	MorphKernelSize int
+	Mode            DetectionMode    // Look for a blob of the color or trace a line of it
+	Line            LineFollowConfig // Settings for DetectLine
 }
 
 // DefaultColorDetectionConfig returns a default configuration for green line detection
@@ -42,30 +51,47 @@ func DefaultColorDetectionConfig() ColorDetectionConfig {
 		WindowName:      "Line Tracking",
 		CameraID:        0,
 		MorphKernelSize: 5,
+		Mode:            DetectBlob,
+		Line:            DefaultLineFollowConfig(),
 	}
 }
 
 // ColorDetector handles detection of colored lines in video feed
 type ColorDetector struct {
 	Config       ColorDetectionConfig
-	webcam       *gocv.VideoCapture
+	source       FrameSource
 	window       *gocv.Window
 	centerRect   image.Rectangle
 	position     LinePosition
 	lastFrame    gocv.Mat
 	displayFrame gocv.Mat
+	detection    DetectionResult // Latest detection, with its frame number and time
+	recorder     *Recorder       // Where frames are recorded, nil when not recording
 	running      bool
+	started      bool // Whether detectionLoop was started, so Close knows to wait for it
 	mu           sync.RWMutex
 	stopChan     chan struct{}
+	doneChan     chan struct{} // Closed when detectionLoop exits
 }
 
-// NewColorDetector creates a new color detector with the given configuration
+// NewColorDetector creates a new color detector with the given configuration,
+// reading from config.Source, or the camera config.CameraID if no source is set
 func NewColorDetector(config ColorDetectionConfig) (*ColorDetector, error) {
-	webcam, err := gocv.OpenVideoCapture(config.CameraID)
+	name := config.Source
+	if name == "" {
+		name = strconv.Itoa(config.CameraID)
+	}
+
+	source, err := OpenFrameSource(name, config.LoopSource)
 	if err != nil {
 		return nil, err
 	}
+	return NewColorDetectorWithSource(config, source), nil
+}
 
+// NewColorDetectorWithSource creates a color detector that reads from an already open frame source.
+// The detector closes the source when it is closed.
+func NewColorDetectorWithSource(config ColorDetectionConfig, source FrameSource) *ColorDetector {
 	// Only create window if explicitly requested
 	var window *gocv.Window
 	if config.ShowWindow {
@@ -74,24 +100,28 @@ func NewColorDetector(config ColorDetectionConfig) (*ColorDetector, error) {
 
 	return &ColorDetector{
 		Config:       config,
-		webcam:       webcam,
+		source:       source,
 		window:       window,
 		position:     LineNotFound,
+		detection:    DetectionResult{Position: LineNotFound},
 		lastFrame:    gocv.NewMat(),
 		displayFrame: gocv.NewMat(),
 		running:      false,
 		stopChan:     make(chan struct{}),
-	}, nil
+		doneChan:     make(chan struct{}),
+	}
 }
 
 // Start begins the color detection in a separate goroutine
 func (cd *ColorDetector) Start() {
 	cd.mu.Lock()
-	if cd.running {
+	// A stopped detector stays stopped, its stop channel is already closed
+	if cd.running || cd.started {
 		cd.mu.Unlock()
 		return
 	}
 	cd.running = true
+	cd.started = true
 	cd.mu.Unlock()
 
 	go cd.detectionLoop()
@@ -114,8 +144,16 @@ func (cd *ColorDetector) Stop() {
 func (cd *ColorDetector) Close() {
 	cd.Stop()
 
-	if cd.webcam != nil {
-		cd.webcam.Close()
+	// Let the loop finish with the current frame before releasing the source
+	cd.mu.RLock()
+	started := cd.started
+	cd.mu.RUnlock()
+	if started {
+		<-cd.doneChan
+	}
+
+	if cd.source != nil {
+		cd.source.Close()
 	}
 
 	if cd.window != nil {
@@ -134,6 +172,12 @@ func (cd *ColorDetector) Close() {
 	}
 }
 
+// Done returns a channel that is closed when detection ends, either because it was stopped
+// or because a file or directory source ran out of frames
+func (cd *ColorDetector) Done() <-chan struct{} {
+	return cd.doneChan
+}
+
 // GetPosition returns the current detected line position
 func (cd *ColorDetector) GetPosition() LinePosition {
 	cd.mu.RLock()
@@ -191,27 +235,202 @@ func (cd *ColorDetector) WaitKey(delay int) int {
 	return cd.window.WaitKey(delay)
 }
 
+// DetectionResult is what the detector found in one frame
+type DetectionResult struct {
+	Seq        int             // Frame sequence number, counting from 1
+	Time       time.Time       // When the frame was read
+	Position   LinePosition    // Where the color is relative to the center region
+	Found      bool            // Whether a large enough contour was found
+	Offset     float64         // Centroid distance from the frame center, -1 at the left edge to 1 at the right
+	Centroid   image.Point     // Center of mass of the largest contour
+	Rect       image.Rectangle // Bounding box of the largest contour
+	Area       float64         // Area of the largest contour in pixels
+	Coverage   float64         // Fraction of the frame covered by the largest contour
+	Confidence float64         // How sure the detector is that this is the target, 0 to 1
+	CenterRect image.Rectangle // Center region of the frame
+	Line       LineResult      // The traced line in DetectLine mode, where Offset is the point steered toward
+}
+
+// detectionBuffers holds the images reused from frame to frame while detecting
+type detectionBuffers struct {
+	processed gocv.Mat
+	hsvImg    gocv.Mat
+	mask      gocv.Mat
+	blob      gocv.Mat // The largest contour filled in, for its moments
+	profile   gocv.Mat // Column sums of one band of the mask, for DetectLine
+	kernel    gocv.Mat
+}
+
+// newDetectionBuffers allocates the buffers for the given config
+func newDetectionBuffers(config ColorDetectionConfig) *detectionBuffers {
+	return &detectionBuffers{
+		processed: gocv.NewMat(),
+		hsvImg:    gocv.NewMat(),
+		mask:      gocv.NewMat(),
+		blob:      gocv.NewMat(),
+		profile:   gocv.NewMat(),
+		kernel:    gocv.GetStructuringElement(gocv.MorphRect, image.Pt(config.MorphKernelSize, config.MorphKernelSize)),
+	}
+}
+
+// Close releases the buffers
+func (db *detectionBuffers) Close() {
+	db.processed.Close()
+	db.hsvImg.Close()
+	db.mask.Close()
+	db.blob.Close()
+	db.profile.Close()
+	db.kernel.Close()
+}
+
+// analyzeFrame looks for the color in a frame, leaving the cleaned up mask in buf.mask
+func (cd *ColorDetector) analyzeFrame(img gocv.Mat, buf *detectionBuffers) DetectionResult {
+	// Set the center rectangle dimensions
+	width := img.Cols()
+	height := img.Rows()
+	centerWidth := width / cd.Config.CenterWidth
+	result := DetectionResult{
+		Position: LineNotFound,
+		CenterRect: image.Rect(
+			(width/2)-(centerWidth/2),
+			0,
+			(width/2)+(centerWidth/2),
+			height,
+		),
+	}
+
+	// Pre-process the image to improve detection
+	gocv.GaussianBlur(img, &buf.processed, image.Pt(5, 5), 0, 0, gocv.BorderDefault)
+	gocv.CvtColor(buf.processed, &buf.hsvImg, gocv.ColorBGRToHSV)
+	gocv.InRangeWithScalar(buf.hsvImg, cd.Config.LowerHSVBound, cd.Config.UpperHSVBound, &buf.mask)
+	gocv.Erode(buf.mask, &buf.mask, buf.kernel)
+	gocv.Dilate(buf.mask, &buf.mask, buf.kernel)
+
+	if cd.Config.Mode == DetectLine {
+		cd.analyzeLine(buf, &result)
+		return result
+	}
+
+	// Find contours in the mask
+	contours := gocv.FindContours(buf.mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	// Find the largest contour, and the total so we know how much of the color it holds
+	largestIdx := -1
+	totalArea := 0.0
+	for i := 0; i < contours.Size(); i++ {
+		area := gocv.ContourArea(contours.At(i))
+		totalArea += area
+		if area > result.Area {
+			result.Area = area
+			largestIdx = i
+		}
+	}
+
+	// Only process if the contour is large enough
+	if result.Area <= cd.Config.MinContourArea || largestIdx < 0 {
+		return result
+	}
+	largest := contours.At(largestIdx)
+	result.Found = true
+	result.Rect = gocv.BoundingRect(largest)
+	result.Coverage = result.Area / float64(width*height)
+	result.Centroid = contourCentroid(buf, contours, largestIdx, result.Rect)
+	result.Offset = clampUnit(float64(result.Centroid.X-width/2) / (float64(width) / 2))
+	result.Confidence = detectionConfidence(largest, result.Area, totalArea, cd.Config.MinContourArea)
+
+	// Calculate center of the contour
+	centerX := result.Rect.Min.X + (result.Rect.Dx() / 2)
+
+	// Determine position relative to center
+	if result.Rect.Overlaps(result.CenterRect) {
+		result.Position = LineCentered
+	} else if centerX < result.CenterRect.Min.X {
+		result.Position = LineLeft
+	} else {
+		result.Position = LineRight
+	}
+	return result
+}
+
+// contourCentroid finds the center of mass of a contour from the image moments of its filled
+// shape, which unlike the bounding box center isn't pulled aside by a stray corner or a curve
+func contourCentroid(buf *detectionBuffers, contours gocv.PointsVector, idx int, rect image.Rectangle) image.Point {
+	if buf.blob.Rows() != buf.mask.Rows() || buf.blob.Cols() != buf.mask.Cols() {
+		buf.blob.Close()
+		buf.blob = gocv.NewMatWithSize(buf.mask.Rows(), buf.mask.Cols(), gocv.MatTypeCV8UC1)
+	}
+	buf.blob.SetTo(gocv.NewScalar(0, 0, 0, 0))
+	gocv.DrawContours(&buf.blob, contours, idx, color.RGBA{255, 255, 255, 0}, -1)
+
+	moments := gocv.Moments(buf.blob, true)
+	if moments["m00"] == 0 {
+		// Too thin to fill, fall back to the middle of the box
+		return image.Pt(rect.Min.X+rect.Dx()/2, rect.Min.Y+rect.Dy()/2)
+	}
+	return image.Pt(int(moments["m10"]/moments["m00"]), int(moments["m01"]/moments["m00"]))
+}
+
+// detectionConfidence rates a contour from 0 to 1 by how far it is above the minimum area, how solid
+// it is and how much of the detected color it holds. Tape on the floor scores high; speckles of a
+// similar color spread over the frame, or a ragged shape barely over the minimum, score low.
+func detectionConfidence(contour gocv.PointVector, area, totalArea, minArea float64) float64 {
+	size := 1.0
+	if minArea > 0 {
+		size = math.Min(area/(4*minArea), 1)
+	}
+
+	solidity := 1.0
+	hull := gocv.NewMat()
+	defer hull.Close()
+	if err := gocv.ConvexHull(contour, &hull, false, true); err == nil {
+		hullPoints := gocv.NewPointVectorFromMat(hull)
+		if hullArea := gocv.ContourArea(hullPoints); hullArea > 0 {
+			solidity = math.Min(area/hullArea, 1)
+		}
+		hullPoints.Close()
+	}
+
+	share := 1.0
+	if totalArea > 0 {
+		share = area / totalArea
+	}
+	return size * solidity * share
+}
+
+// clampUnit limits a value to -1..1
+func clampUnit(value float64) float64 {
+	return math.Max(-1, math.Min(1, value))
+}
+
+// GetDetection returns everything found in the latest frame
+func (cd *ColorDetector) GetDetection() DetectionResult {
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+	return cd.detection
+}
+
+// SetRecorder starts writing every frame and its detection to the recorder, nil stops recording
+func (cd *ColorDetector) SetRecorder(recorder *Recorder) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	cd.recorder = recorder
+}
+
 // detectionLoop is the main processing loop for color detection
 func (cd *ColorDetector) detectionLoop() {
+	defer close(cd.doneChan)
+
 	// Prepare images for processing
 	img := gocv.NewMat()
 	defer img.Close()
 
-	processed := gocv.NewMat()
-	defer processed.Close()
-
-	hsvImg := gocv.NewMat()
-	defer hsvImg.Close()
-
-	mask := gocv.NewMat()
-	defer mask.Close()
+	buf := newDetectionBuffers(cd.Config)
+	defer buf.Close()
 
 	coloredMask := gocv.NewMat()
 	defer coloredMask.Close()
 
-	kernel := gocv.GetStructuringElement(gocv.MorphRect, image.Pt(cd.Config.MorphKernelSize, cd.Config.MorphKernelSize))
-	defer kernel.Close()
-
 	// Define drawing colors
 	green := color.RGBA{0, 255, 0, 0}
 	red := color.RGBA{0, 0, 255, 0}
@@ -219,106 +438,68 @@ func (cd *ColorDetector) detectionLoop() {
 	black := color.RGBA{0, 0, 0, 0}
 	white := color.RGBA{255, 255, 255, 0}
 
+	readFailures := failureLog{prefix: "Error reading frame"}
+	seq := 0
+
 	for {
 		select {
 		case <-cd.stopChan:
 			return
 		default:
-			// Read frame from webcam
-			if ok := cd.webcam.Read(&img); !ok || img.Empty() {
+			// Read the next frame from the camera, file or stream
+			if err := cd.source.Read(&img); err != nil {
+				if errors.Is(err, ErrEndOfFrames) {
+					log.Println("Frame source finished - Stopping detection")
+					cd.mu.Lock()
+					cd.position = LineNotFound
+					cd.detection = DetectionResult{Seq: seq, Time: time.Now(), Position: LineNotFound}
+					cd.mu.Unlock()
+					return
+				}
+				if !errors.Is(err, ErrNoFrame) {
+					readFailures.fail(err)
+				}
 				time.Sleep(10 * time.Millisecond) // Small delay to avoid busy waiting
 				continue
 			}
+			readFailures.ok()
+			seq++
+			readAt := time.Now()
 
 			// Clone for storage
 			originalImg := img.Clone()
-
-			// Set the center rectangle dimensions
 			width := img.Cols()
 			height := img.Rows()
-			centerWidth := width / cd.Config.CenterWidth
-			cd.centerRect = image.Rect(
-				(width/2)-(centerWidth/2),
-				0,
-				(width/2)+(centerWidth/2),
-				height,
-			)
-
-			// Pre-process the image to improve detection
-			gocv.GaussianBlur(img, &processed, image.Pt(5, 5), 0, 0, gocv.BorderDefault)
-			gocv.CvtColor(processed, &hsvImg, gocv.ColorBGRToHSV)
-			gocv.InRangeWithScalar(hsvImg, cd.Config.LowerHSVBound, cd.Config.UpperHSVBound, &mask)
-			gocv.Erode(mask, &mask, kernel)
-			gocv.Dilate(mask, &mask, kernel)
-			gocv.CvtColor(mask, &coloredMask, gocv.ColorGrayToBGR)
-
-			// Find contours in the mask
-			contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
-
-			foundColor := false
-			var largestIdx int = -1
-			maxArea := 0.0
-			var statusText string
-			var statusColor color.RGBA
-			var position LinePosition
-
-			// Process contours if any are found
-			if contours.Size() > 0 {
-				// Find the largest contour
-				for i := 0; i < contours.Size(); i++ {
-					area := gocv.ContourArea(contours.At(i))
-					if area > maxArea {
-						maxArea = area
-						largestIdx = i
-					}
-				}
 
-				// Only process if the contour is large enough
-				if maxArea > cd.Config.MinContourArea && largestIdx >= 0 {
-					foundColor = true
-					rect := gocv.BoundingRect(contours.At(largestIdx))
-
-					// Draw the bounding rectangle on both original and mask
-					gocv.Rectangle(&originalImg, rect, green, 2)
-					gocv.Rectangle(&coloredMask, rect, green, 2)
-
-					// Calculate center of the contour
-					centerX := rect.Min.X + (rect.Dx() / 2)
-
-					// Determine position relative to center
-					if rect.Overlaps(cd.centerRect) {
-						position = LineCentered
-						statusText = string(LineCentered)
-						statusColor = green
-					} else if centerX < cd.centerRect.Min.X {
-						position = LineLeft
-						statusText = string(LineLeft)
-						statusColor = red
-					} else {
-						position = LineRight
-						statusText = string(LineRight)
-						statusColor = red
-					}
+			detection := cd.analyzeFrame(img, buf)
+			detection.Seq = seq
+			detection.Time = readAt
+			gocv.CvtColor(buf.mask, &coloredMask, gocv.ColorGrayToBGR)
+
+			position := detection.Position
+			statusText := string(position)
+			statusColor := red
+			if detection.Found {
+				// Draw the bounding rectangle and centroid on both original and mask
+				gocv.Rectangle(&originalImg, detection.Rect, green, 2)
+				gocv.Rectangle(&coloredMask, detection.Rect, green, 2)
+				gocv.Circle(&originalImg, detection.Centroid, 5, green, -1)
+				gocv.Circle(&coloredMask, detection.Centroid, 5, green, -1)
+				statusText = fmt.Sprintf("%s %+.2f", position, detection.Offset)
+				if position == LineCentered {
+					statusColor = green
 				}
 			}
 
-			// If no color was found or contour was too small
-			if !foundColor {
-				position = LineNotFound
-				statusText = string(LineNotFound)
-				statusColor = red
-			}
-
 			// Draw center region for reference on both views
-			gocv.Rectangle(&originalImg, cd.centerRect, blue, 1)
-			gocv.Rectangle(&coloredMask, cd.centerRect, blue, 1)
+			gocv.Rectangle(&originalImg, detection.CenterRect, blue, 1)
+			gocv.Rectangle(&coloredMask, detection.CenterRect, blue, 1)
 
 			// Create the display with the original on top and mask on bottom
 			statusBarHeight := 60
 			totalHeight := (height * 2) + statusBarHeight
 
 			combinedDisplay := gocv.NewMatWithSize(totalHeight, width, gocv.MatTypeCV8UC3)
-			defer combinedDisplay.Close()
 
 			gocv.Rectangle(&combinedDisplay, image.Rect(0, 0, width, totalHeight), black, -1)
 
@@ -342,9 +523,20 @@ func (cd *ColorDetector) detectionLoop() {
 			textY := height + (statusBarHeight / 2) + 10
 			gocv.PutText(&combinedDisplay, statusText, image.Pt(textX, textY), gocv.FontHersheyDuplex, 1.5, statusColor, 2)
 
+			// Keep the raw frame, before any drawing, so it can be analyzed again later. It is queued
+			// before the detection is published so it is logged ahead of any decision made on it.
+			cd.mu.RLock()
+			recorder := cd.recorder
+			cd.mu.RUnlock()
+			if recorder != nil {
+				recorder.recordFrame(img, detection)
+			}
+
 			// Update the stored position and frames
 			cd.mu.Lock()
 			cd.position = position
+			cd.detection = detection
+			cd.centerRect = detection.CenterRect
 
 			// Update stored frames (close old ones first)
 			if !cd.lastFrame.Empty() {
@@ -360,6 +552,7 @@ func (cd *ColorDetector) detectionLoop() {
 
 			// Clean up
 			originalImg.Close()
+			combinedDisplay.Close()
 		}
 	}
 }
@@ -1,11 +1,33 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"gocv.io/x/gocv"
 	"log"
+	"math"
+	"sync"
 	"time"
 )
 
+// SteeringMode is how the tracker turns toward the color
+type SteeringMode string
+
+const (
+	SteeringBangBang SteeringMode = "bang-bang" // Spin at fixed speeds until the color is centered, then drive straight
+	SteeringPID      SteeringMode = "pid"       // Curve toward the color in proportion to its offset while driving forward
+)
+
+// ParseSteeringMode returns the steering mode with the given name
+func ParseSteeringMode(name string) (SteeringMode, error) {
+	switch mode := SteeringMode(name); mode {
+	case SteeringBangBang, SteeringPID:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown steering mode %q, expected bang-bang or pid", name)
+	}
+}
+
 // ColorTrackerConfig holds configuration for the color tracking behavior
 type ColorTrackerConfig struct {
 	// Speed settings
@@ -13,6 +35,11 @@ type ColorTrackerConfig struct {
 	MinRotationSpeed int16 // Minimum speed for fine adjustments
 	ForwardSpeed     int16 // Speed for moving forward when color is centered
 
+	// Steering settings
+	SteeringMode SteeringMode // How to turn toward the color
+	Steering     PIDConfig    // SteeringPID gains; the error is the detection offset, the output a turn speed in mm/s
+	TurnSlowdown float64      // Fraction of ForwardSpeed given up at the largest SteeringPID turn, 0 to 1
+
 	// Timing and behavior settings
 	UpdateInterval time.Duration // How often to check color position
 	StopDelay      time.Duration // How long to wait before stopping after color lost
@@ -20,6 +47,10 @@ type ColorTrackerConfig struct {
 
 	// Color detection settings
 	DetectorConfig ColorDetectionConfig
+
+	// Recording settings, each run is recorded to a new directory under RecordDir
+	RecordDir    string       // Where to record frames and decisions, empty disables recording
+	RecordFormat RecordFormat // How to store the frames
 }
 
 // DefaultColorTrackerConfig returns reasonable default settings
@@ -28,10 +59,20 @@ func DefaultColorTrackerConfig() ColorTrackerConfig {
 		MaxRotationSpeed: 80,  // Maximum rotation speed for large adjustments
 		MinRotationSpeed: 35,  // Minimum rotation speed for fine adjustments
 		ForwardSpeed:     130, // Moderate forward speed
-		UpdateInterval:   50 * time.Millisecond,
-		StopDelay:        300 * time.Millisecond,
-		MaxSearchTime:    30 * time.Second, // Stop searching after 30 seconds
-		DetectorConfig:   DefaultColorDetectionConfig(),
+		SteeringMode:     SteeringBangBang,
+		Steering: PIDConfig{
+			Kp:            80, // Color at the edge of the frame turns at the full OutputLimit
+			Ki:            20,
+			Kd:            5,
+			IntegralLimit: 0.5,
+			OutputLimit:   80, // Same as MaxRotationSpeed
+		},
+		TurnSlowdown:   0.6,
+		UpdateInterval: 50 * time.Millisecond,
+		StopDelay:      300 * time.Millisecond,
+		MaxSearchTime:  30 * time.Second, // Stop searching after 30 seconds
+		DetectorConfig: DefaultColorDetectionConfig(),
+		RecordFormat:   RecordPNG,
 	}
 }
 
@@ -41,21 +82,33 @@ type ColorTracker struct {
 	colorDetector  *ColorDetector
 	roomba         *Roomba
 	running        bool
+	mu             sync.Mutex // Guards running, Stop can be called from the control loop and other goroutines at once
 	stopChan       chan struct{}
+	stopOnce       sync.Once
+	loopDone       chan struct{} // Closed when controlLoop exits, nil until started
 	colorLastSeen  time.Time
-	lastPosition   LinePosition // Track previous position to reduce oscillation
-	searchStarted  time.Time    // When the search started
-	colorEverFound bool         // If we ever found the color
+	lastPosition   LinePosition   // Track previous position to reduce oscillation
+	searchStarted  time.Time      // When the search started
+	colorEverFound bool           // If we ever found the color
+	state          RobotState     // Searching or tracking while running, idle otherwise
+	stateMu        sync.Mutex     // Guards state, held while notifying so callbacks see changes in order
+	steering       *PIDController // Turn speed from the detection offset, for SteeringPID
+	atIntersection bool           // Whether the line ahead crosses another, so it's logged once per crossing
+	onLineEnd      func()
+	onStateChange  func(RobotState)
+	clock          func() time.Time // Current time, replaced when replaying a recording
+	issued         []DriveCommand   // Commands sent during the current decision
+	recorder       *Recorder        // Where decisions are recorded, nil when not recording
 }
 
-// NewColorTracker creates a new color tracker
+// NewColorTracker creates a new color tracker, recording the run if config.RecordDir is set
 func NewColorTracker(config ColorTrackerConfig, roomba *Roomba) (*ColorTracker, error) {
 	detector, err := NewColorDetector(config.DetectorConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ColorTracker{
+	tracker := &ColorTracker{
 		config:         config,
 		colorDetector:  detector,
 		roomba:         roomba,
@@ -65,22 +118,77 @@ func NewColorTracker(config ColorTrackerConfig, roomba *Roomba) (*ColorTracker,
 		lastPosition:   LineNotFound,
 		searchStarted:  time.Time{},
 		colorEverFound: false,
-	}, nil
+		state:          StateIdle,
+		steering:       NewPIDController(config.Steering),
+		clock:          time.Now,
+	}
+
+	if config.RecordDir != "" {
+		recorder, err := NewTimestampedRecorder(config.RecordDir, config.RecordFormat)
+		if err != nil {
+			detector.Close()
+			return nil, err
+		}
+		log.Printf("Recording color tracking to %s", recorder.Dir())
+		tracker.recorder = recorder
+		detector.SetRecorder(recorder)
+	}
+	return tracker, nil
+}
+
+// OnStateChange registers a callback run whenever the tracker starts searching,
+// starts tracking or stops. Register it before calling Start.
+func (ct *ColorTracker) OnStateChange(callback func(RobotState)) {
+	ct.onStateChange = callback
+}
+
+// OnLineEnd registers a callback run when the tracker stops at the end of a line in DetectLine mode.
+// Register it before calling Start.
+func (ct *ColorTracker) OnLineEnd(callback func()) {
+	ct.onLineEnd = callback
+}
+
+// State returns what the tracker is doing
+func (ct *ColorTracker) State() RobotState {
+	ct.stateMu.Lock()
+	defer ct.stateMu.Unlock()
+	return ct.state
+}
+
+// setState records the state and notifies the callback if it changed
+func (ct *ColorTracker) setState(state RobotState) {
+	ct.stateMu.Lock()
+	defer ct.stateMu.Unlock()
+
+	// A decision finishing after Stop mustn't bring a stopped tracker back to life
+	if ct.state == state || (state != StateIdle && !ct.isRunning()) {
+		return
+	}
+	ct.state = state
+	if ct.onStateChange != nil {
+		ct.onStateChange(state)
+	}
 }
 
 // Start begins the color tracking behavior
 func (ct *ColorTracker) Start() {
+	ct.mu.Lock()
 	if ct.running {
+		ct.mu.Unlock()
 		return
 	}
-
 	ct.running = true
-	ct.searchStarted = time.Now()
+	ct.loopDone = make(chan struct{})
+	ct.mu.Unlock()
+
+	ct.searchStarted = ct.clock()
 	ct.colorEverFound = false
+	ct.steering.Reset()
 	ct.colorDetector.Start()
+	ct.setState(StateSearching)
 
 	// Begin searching by rotating
-	ct.roomba.Drive(ct.config.MinRotationSpeed, -1) // Start rotating clockwise at minimal speed
+	ct.roomba.Spin(-ct.config.MinRotationSpeed) // Start rotating clockwise at minimal speed
 	log.Println("Starting color search - Rotating clockwise")
 
 	// Start the control loop
@@ -89,14 +197,16 @@ func (ct *ColorTracker) Start() {
 
 // Stop halts the color tracking behavior
 func (ct *ColorTracker) Stop() {
+	ct.mu.Lock()
 	if !ct.running {
+		ct.mu.Unlock()
 		return
 	}
-
 	ct.running = false
+	ct.mu.Unlock()
 
 	// Signal the control loop to stop
-	close(ct.stopChan)
+	ct.stopOnce.Do(func() { close(ct.stopChan) })
 
 	// Make sure to stop the detector
 	if ct.colorDetector != nil {
@@ -107,20 +217,35 @@ func (ct *ColorTracker) Stop() {
 	if ct.roomba != nil {
 		ct.roomba.Stop()
 	}
+	ct.setState(StateIdle)
 
 	log.Println("Color tracker stopped")
 }
 
 // Close releases all resources
 func (ct *ColorTracker) Close() {
-	// First stop tracking
+	// First stop tracking, and let the control loop finish its current decision
 	ct.Stop()
+	ct.mu.Lock()
+	loopDone := ct.loopDone
+	ct.mu.Unlock()
+	if loopDone != nil {
+		<-loopDone
+	}
 
 	// Then close detector resources
 	if ct.colorDetector != nil {
 		ct.colorDetector.Close()
 		ct.colorDetector = nil
 	}
+
+	// Finish the recording once the detector has stopped adding frames
+	if ct.recorder != nil {
+		if err := ct.recorder.Close(); err != nil {
+			log.Printf("Error closing recording: %v", err)
+		}
+		ct.recorder = nil
+	}
 }
 
 // SetColorRange allows changing the color being detected
@@ -136,8 +261,17 @@ func (ct *ColorTracker) GetColorDetector() *ColorDetector {
 	return ct.colorDetector
 }
 
+// isRunning reports whether the tracker is running
+func (ct *ColorTracker) isRunning() bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.running
+}
+
 // controlLoop is the main control loop for color tracking
 func (ct *ColorTracker) controlLoop() {
+	defer close(ct.loopDone)
+
 	ticker := time.NewTicker(ct.config.UpdateInterval)
 	defer ticker.Stop()
 
@@ -158,15 +292,19 @@ func (ct *ColorTracker) controlLoop() {
 				return
 			}
 		case <-ticker.C:
-			if !ct.running {
+			if !ct.isRunning() {
 				return
 			}
 
+			// Renew the motion lease every tick, even when the current command carries on
+			ct.roomba.Heartbeat()
+
 			// Check current position
-			position := LineNotFound
+			detection := DetectionResult{Position: LineNotFound}
 			if ct.colorDetector != nil {
-				position = ct.colorDetector.GetPosition()
+				detection = ct.colorDetector.GetDetection()
 			}
+			position := detection.Position
 
 			// If we found color for the first time, mark it
 			if position != LineNotFound && !ct.colorEverFound {
@@ -178,11 +316,143 @@ func (ct *ColorTracker) controlLoop() {
 			}
 
 			// Handle the position
-			ct.handleColorPosition(position)
+			ct.decide(detection)
 		}
 	}
 }
 
+// decide handles one detection and records the decision when recording
+func (ct *ColorTracker) decide(detection DetectionResult) {
+	ct.issued = ct.issued[:0]
+
+	line := detection.Line
+	if line.Intersection != ct.atIntersection {
+		ct.atIntersection = line.Intersection
+		if line.Intersection {
+			log.Println("Line crosses another - Keeping to the line")
+		}
+	}
+
+	if line.End && line.Visible <= 1 {
+		ct.endOfLine()
+	} else if ct.config.SteeringMode == SteeringPID && detection.Found {
+		ct.steer(detection)
+	} else {
+		// Start the next approach afresh rather than with what was built up before the color was lost
+		if !detection.Found {
+			ct.steering.Reset()
+		}
+		ct.handleColorPosition(detection.Position)
+	}
+
+	if ct.recorder != nil {
+		ct.recorder.recordDecision(RecordEntry{
+			Seq:      detection.Seq,
+			Time:     ct.clock(),
+			Position: detection.Position,
+			Offset:   detection.Offset,
+			Commands: append([]DriveCommand(nil), ct.issued...),
+			Stopped:  !ct.isRunning(),
+		})
+	}
+}
+
+// drive sends a Drive command and notes it for the recording
+func (ct *ColorTracker) drive(velocity, radius int16) error {
+	ct.issued = append(ct.issued, DriveCommand{Velocity: velocity, Radius: radius})
+	return ct.roomba.Drive(velocity, radius)
+}
+
+// spin turns in place like Roomba.Spin and notes the command for the recording
+func (ct *ColorTracker) spin(speed int16) error {
+	if speed < 0 {
+		return ct.drive(-speed, SpinClockwiseRadius)
+	}
+	return ct.drive(speed, SpinCounterClockwiseRadius)
+}
+
+// halt stops the wheels and notes the command for the recording
+func (ct *ColorTracker) halt() error {
+	ct.issued = append(ct.issued, DriveCommand{})
+	return ct.roomba.Stop()
+}
+
+// endOfLine stops the tracker once the end of the line has reached the nearest band
+func (ct *ColorTracker) endOfLine() {
+	log.Println("Reached the end of the line - Stopping tracker")
+	if err := ct.halt(); err != nil {
+		log.Printf("Error controlling Roomba: %v", err)
+	}
+	ct.Stop()
+
+	if ct.onLineEnd != nil {
+		ct.onLineEnd()
+	}
+}
+
+// steer curves toward the color with the PID controller, slowing down for sharper turns
+func (ct *ColorTracker) steer(detection DetectionResult) {
+	ct.colorLastSeen = ct.clock()
+	ct.setState(StateTracking)
+	ct.lastPosition = detection.Position
+
+	// Steer to bring the offset to zero; a color to the right means turning clockwise, a negative turn
+	turn := ct.steering.Update(-detection.Offset, ct.clock())
+
+	limit := ct.config.Steering.OutputLimit
+	if limit <= 0 {
+		limit = float64(ct.config.MaxRotationSpeed)
+	}
+	slowdown := ct.config.TurnSlowdown * math.Min(math.Abs(turn)/limit, 1)
+	forward := float64(ct.config.ForwardSpeed) * (1 - slowdown)
+
+	velocity, radius := arcToDrive(forward, turn)
+	err := ct.drive(velocity, radius)
+	log.Printf("Color offset %+.2f - Steering %s", detection.Offset, DriveCommand{Velocity: velocity, Radius: radius})
+
+	if err != nil {
+		log.Printf("Error controlling Roomba: %v", err)
+
+		// The safety interlock tripped, so there is no point in continuing
+		if errors.Is(err, ErrSafetyInterlock) {
+			ct.Stop()
+		}
+	}
+}
+
+// arcToDrive converts a forward speed and a turn speed, both in mm/s, to a Drive velocity and radius.
+// The turn speed is how much faster the right wheel goes than the middle, positive turning counter-clockwise.
+// Drive works on every Roomba, unlike DriveDirect which needs the OI.
+func arcToDrive(forward, turn float64) (int16, int16) {
+	velocity := int16(math.Round(forward))
+	if math.Abs(turn) < 0.5 {
+		return velocity, StraightRadius
+	}
+	if velocity <= 0 {
+		// No forward speed left, turn on the spot
+		speed := int16(math.Round(math.Abs(turn)))
+		if turn > 0 {
+			return speed, SpinCounterClockwiseRadius
+		}
+		return speed, SpinClockwiseRadius
+	}
+
+	radius := forward * WheelBase / 2 / turn
+	if math.Abs(radius) > float64(MaxRadius) {
+		return velocity, StraightRadius
+	}
+
+	// Radius 1 and -1 mean spin, keep tight arcs just outside them
+	r := int16(math.Round(radius))
+	if r >= -1 && r <= 1 {
+		r = 2
+		if radius < 0 {
+			r = -2
+		}
+	}
+	return velocity, r
+}
+
 // handleColorPosition reacts to the detected color position
 func (ct *ColorTracker) handleColorPosition(position LinePosition) {
 	var err error
@@ -190,26 +460,27 @@ func (ct *ColorTracker) handleColorPosition(position LinePosition) {
 	switch position {
 	case LineNotFound:
 		// Check if we recently saw the color
-		if !ct.colorLastSeen.IsZero() && time.Since(ct.colorLastSeen) > ct.config.StopDelay {
+		if !ct.colorLastSeen.IsZero() && ct.clock().Sub(ct.colorLastSeen) > ct.config.StopDelay {
 			// Color has been missing for too long - stop the robot
 			log.Println("Color lost - Stopping")
-			err = ct.roomba.Stop()
+			err = ct.halt()
 			ct.colorLastSeen = time.Time{} // Reset the last seen time
+			ct.setState(StateSearching)
 
 			// If we've been running a while and now lost the color, stop the tracker
-			if ct.colorEverFound && time.Since(ct.searchStarted) > 5*time.Second {
+			if ct.colorEverFound && ct.clock().Sub(ct.searchStarted) > 5*time.Second {
 				log.Println("Color tracking session complete - Stopping tracker")
 				ct.Stop() // This will also close the stopChan and end the control loop
 				return
 			}
 		} else if ct.colorLastSeen.IsZero() {
 			// If we've never seen the color, use a slow search speed
-			err = ct.roomba.Drive(ct.config.MinRotationSpeed, -1) // Slow clockwise rotation
+			err = ct.spin(-ct.config.MinRotationSpeed) // Slow clockwise rotation
 
 			// Check if we've been searching too long without finding anything
-			if time.Since(ct.searchStarted) > ct.config.MaxSearchTime && !ct.colorEverFound {
+			if ct.clock().Sub(ct.searchStarted) > ct.config.MaxSearchTime && !ct.colorEverFound {
 				log.Println("Search timeout - No color found")
-				err = ct.roomba.Stop()
+				err = ct.halt()
 				ct.Stop() // Stop the tracker
 				return
 			}
@@ -219,14 +490,16 @@ func (ct *ColorTracker) handleColorPosition(position LinePosition) {
 
 	case LineCentered:
 		// Color is centered - move forward
-		ct.colorLastSeen = time.Now()
-		err = ct.roomba.Drive(ct.config.ForwardSpeed, StraightRadius)
+		ct.colorLastSeen = ct.clock()
+		ct.setState(StateTracking)
+		err = ct.drive(ct.config.ForwardSpeed, StraightRadius)
 		log.Println("Color CENTERED - Moving forward")
 		ct.lastPosition = LineCentered
 
 	case LineLeft:
 		// Color is to the left - rotate counter-clockwise
-		ct.colorLastSeen = time.Now()
+		ct.colorLastSeen = ct.clock()
+		ct.setState(StateTracking)
 
 		// Use different speeds based on whether we're switching directions
 		rotationSpeed := ct.config.MinRotationSpeed
@@ -238,13 +511,14 @@ func (ct *ColorTracker) handleColorPosition(position LinePosition) {
 			rotationSpeed = ct.config.MinRotationSpeed
 		}
 
-		err = ct.roomba.Drive(rotationSpeed, 1) // Counter-clockwise
+		err = ct.spin(rotationSpeed) // Counter-clockwise
 		log.Println("Color LEFT - Rotating left at speed", rotationSpeed)
 		ct.lastPosition = LineLeft
 
 	case LineRight:
 		// Color is to the right - rotate clockwise
-		ct.colorLastSeen = time.Now()
+		ct.colorLastSeen = ct.clock()
+		ct.setState(StateTracking)
 
 		// Use different speeds based on whether we're switching directions
 		rotationSpeed := ct.config.MinRotationSpeed
@@ -256,12 +530,17 @@ func (ct *ColorTracker) handleColorPosition(position LinePosition) {
 			rotationSpeed = ct.config.MinRotationSpeed
 		}
 
-		err = ct.roomba.Drive(rotationSpeed, -1) // Clockwise
+		err = ct.spin(-rotationSpeed) // Clockwise
 		log.Println("Color RIGHT - Rotating right at speed", rotationSpeed)
 		ct.lastPosition = LineRight
 	}
 
 	if err != nil {
 		log.Printf("Error controlling Roomba: %v", err)
+
+		// The safety interlock tripped, so there is no point in continuing
+		if errors.Is(err, ErrSafetyInterlock) {
+			ct.Stop()
+		}
 	}
 }
@@ -0,0 +1,277 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Delays the Roomba needs after certain commands before it accepts the next one
+const (
+	modeChangeDelay = 20 * time.Millisecond // After Start, Control, Safe, Full and cleaning commands
+)
+
+var (
+	// ErrNotConnected is returned when a command is sent before Connect or after Close
+	ErrNotConnected = errors.New("roomba is not connected")
+	// ErrCommandDropped is returned for motion commands discarded in favour of a stop
+	ErrCommandDropped = errors.New("command dropped by a higher priority stop")
+)
+
+// command is a single frame waiting to be written to the Roomba
+type command struct {
+	frame    []byte        // Bytes to write
+	replyLen int           // Number of bytes to read back after writing
+	timeout  time.Duration // How long to wait for the reply, sensorReadTimeout if zero
+	pace     time.Duration // How long to wait after writing before the next command
+	urgent   bool          // Urgent commands jump ahead of everything queued
+	motion   bool          // Motion commands are dropped when a stop jumps the line
+	stop     bool          // Stop commands discard queued motion commands
+	override bool          // Motion sent by the safety supervisor while the interlock is engaged
+	drives   bool          // Hands the wheels to the Roomba's own behaviors, e.g. cleaning or docking
+	result   chan commandResult
+}
+
+// commandResult carries the outcome of a command back to its caller
+type commandResult struct {
+	reply []byte
+	err   error
+}
+
+// commandQueue holds commands for the writer goroutine, urgent ones first
+type commandQueue struct {
+	mu     sync.Mutex
+	urgent []*command
+	normal []*command
+	notify chan struct{}
+}
+
+// newCommandQueue creates an empty queue
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push adds a command to the queue and wakes the writer
+func (q *commandQueue) push(cmd *command) {
+	q.mu.Lock()
+	if cmd.urgent {
+		q.urgent = append(q.urgent, cmd)
+	} else {
+		q.normal = append(q.normal, cmd)
+	}
+
+	// A stop makes any motion still waiting in line obsolete
+	if cmd.stop {
+		q.dropMotionLocked()
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next command, or returns nil if the queue is empty
+func (q *commandQueue) pop() *command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.urgent) > 0 {
+		cmd := q.urgent[0]
+		q.urgent = q.urgent[1:]
+		return cmd
+	}
+	if len(q.normal) > 0 {
+		cmd := q.normal[0]
+		q.normal = q.normal[1:]
+		return cmd
+	}
+	return nil
+}
+
+// dropMotion fails every queued motion command with ErrCommandDropped
+func (q *commandQueue) dropMotion() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dropMotionLocked()
+}
+
+// dropMotionLocked is dropMotion for callers already holding the lock
+func (q *commandQueue) dropMotionLocked() {
+	kept := q.normal[:0]
+	for _, cmd := range q.normal {
+		if cmd.motion {
+			cmd.result <- commandResult{err: ErrCommandDropped}
+			continue
+		}
+		kept = append(kept, cmd)
+	}
+	q.normal = kept
+}
+
+// drain fails every queued command with the given error
+func (q *commandQueue) drain(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, cmd := range append(q.urgent, q.normal...) {
+		cmd.result <- commandResult{err: err}
+	}
+	q.urgent = nil
+	q.normal = nil
+}
+
+// startWriter launches the goroutine that owns all port I/O
+func (r *Roomba) startWriter() {
+	r.writerMu.Lock()
+	defer r.writerMu.Unlock()
+
+	if r.writerStop != nil {
+		return
+	}
+	r.writerStop = make(chan struct{})
+	r.writerDone = make(chan struct{})
+
+	go r.writerLoop(r.writerStop, r.writerDone)
+}
+
+// stopWriter stops the writer goroutine and fails anything still queued
+func (r *Roomba) stopWriter() {
+	r.writerMu.Lock()
+	stop, done := r.writerStop, r.writerDone
+	r.writerStop, r.writerDone = nil, nil
+	r.writerMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	r.queue.drain(ErrNotConnected)
+}
+
+// submit queues a command and waits for the writer to execute it
+func (r *Roomba) submit(cmd *command) ([]byte, error) {
+	r.writerMu.Lock()
+	done := r.writerDone
+	r.writerMu.Unlock()
+
+	if done == nil {
+		return nil, ErrNotConnected
+	}
+
+	// Refuse motion while the safety interlock is engaged, no matter who asks.
+	// The writer checks again before sending, for commands already queued when it trips.
+	if err := r.interlockError(cmd); err != nil {
+		return nil, err
+	}
+
+	// Every motion command takes out a lease on the wheels that stopping gives up
+	if cmd.stop {
+		r.cancelLease()
+	} else if cmd.motion {
+		r.renewLease()
+	}
+
+	cmd.result = make(chan commandResult, 1)
+	r.queue.push(cmd)
+
+	select {
+	case res := <-cmd.result:
+		return res.reply, res.err
+	case <-done:
+		// The writer may have finished this command just before exiting
+		select {
+		case res := <-cmd.result:
+			return res.reply, res.err
+		default:
+			return nil, ErrNotConnected
+		}
+	}
+}
+
+// interlockError refuses motion commands, and commands that set the Roomba driving by itself,
+// while the safety interlock is engaged, except those the safety supervisor sends to back away
+func (r *Roomba) interlockError(cmd *command) error {
+	if !(cmd.motion || cmd.drives) || cmd.override {
+		return nil
+	}
+	if reason, tripped := r.Interlock(); tripped {
+		return fmt.Errorf("%w: %s", ErrSafetyInterlock, reason)
+	}
+	return nil
+}
+
+// writerLoop executes queued commands one at a time until stopped
+func (r *Roomba) writerLoop(stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		cmd := r.queue.pop()
+		if cmd == nil {
+			select {
+			case <-stop:
+				return
+			case <-r.queue.notify:
+			}
+			continue
+		}
+
+		// Check the interlock again at the last moment, it may have tripped while the command waited in line
+		if err := r.interlockError(cmd); err != nil {
+			cmd.result <- commandResult{err: err}
+			continue
+		}
+
+		reply, err := r.execute(cmd)
+		cmd.result <- commandResult{reply: reply, err: err}
+
+		// A failed port won't recover by itself, leave it to the reconnect supervisor
+		if isIOError(err) && r.connectionLost(err) {
+			return
+		}
+
+		// Pace the next command instead of sleeping after every write
+		if cmd.pace > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(cmd.pace):
+			}
+		}
+	}
+}
+
+// execute writes a command frame and reads back its reply, if any
+func (r *Roomba) execute(cmd *command) ([]byte, error) {
+	if cmd.replyLen > 0 {
+		// Discard any stale bytes so the reply lines up with this request
+		if t, ok := r.port.(inputBufferResetter); ok {
+			t.ResetInputBuffer()
+		}
+	}
+
+	if _, err := r.port.Write(cmd.frame); err != nil {
+		return nil, err
+	}
+
+	if cmd.replyLen == 0 {
+		return nil, nil
+	}
+
+	timeout := cmd.timeout
+	if timeout == 0 {
+		timeout = sensorReadTimeout
+	}
+
+	reply := make([]byte, cmd.replyLen)
+	if err := r.readFull(reply, timeout); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,450 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Duration is a duration written as text such as "300ms" in config files.
+// It is parsed during validation so a bad value is reported with its field.
+type Duration string
+
+// durationOf formats a time.Duration for a config file
+func durationOf(d time.Duration) Duration {
+	return Duration(d.String())
+}
+
+// Value returns the parsed duration, 0 if it is invalid
+func (d Duration) Value() time.Duration {
+	parsed, _ := time.ParseDuration(string(d))
+	return parsed
+}
+
+// HSVRange is a color preset, the HSV bounds a pixel must fall within.
+// Hue runs from 0 to 180, saturation and value from 0 to 255, as in OpenCV.
+type HSVRange struct {
+	Lower [3]float64 `json:"lower"`
+	Upper [3]float64 `json:"upper"`
+}
+
+// ServerConfig holds the web server settings
+type ServerConfig struct {
+	Address string `json:"address"` // Listen address, e.g. :8080
+}
+
+// SerialConfig holds the settings for the link to the Roomba
+type SerialConfig struct {
+	Port        string   `json:"port"`         // Serial port or tcp:// bridge, empty to discover it
+	Baud        int      `json:"baud"`         // Baud rate to open the port at
+	ProbeBaud   bool     `json:"probe_baud"`   // Try other common rates if the Roomba doesn't answer
+	Mode        string   `json:"mode"`         // OI mode to drive in, safe or full
+	MotionLease Duration `json:"motion_lease"` // Stop if motion is not renewed within this window, 0 disables
+	USBVID      string   `json:"usb_vid"`      // USB vendor ID of the cable, used when no port is set
+	USBPID      string   `json:"usb_pid"`      // USB product ID of the cable, used when no port is set
+	USBSerial   string   `json:"usb_serial"`   // USB serial number, to pick one of several identical cables
+}
+
+// CameraConfig holds the camera settings
+type CameraConfig struct {
+	ID         int    `json:"id"`          // Camera index to open
+	Source     string `json:"source"`      // Video file, image directory, stream URL or synthetic instead of the camera
+	Loop       bool   `json:"loop"`        // Replay a file or directory source from the start when it ends
+	ShowWindow bool   `json:"show_window"` // Show the detection window, needs a display
+	WindowName string `json:"window_name"` // Title of the detection window
+}
+
+// RecordConfig holds the settings for recording tracking runs
+type RecordConfig struct {
+	Dir    string `json:"dir"`    // Each run is recorded to a new directory under this one, empty disables recording
+	Format string `json:"format"` // Frame format: png, jpg or avi
+}
+
+// TrackerSettings holds the tunable parts of ColorTrackerConfig
+type TrackerSettings struct {
+	MaxRotationSpeed int16     `json:"max_rotation_speed"`
+	MinRotationSpeed int16     `json:"min_rotation_speed"`
+	ForwardSpeed     int16     `json:"forward_speed"`
+	UpdateInterval   Duration  `json:"update_interval"`
+	StopDelay        Duration  `json:"stop_delay"`
+	MaxSearchTime    Duration  `json:"max_search_time"`
+	SteeringMode     string    `json:"steering_mode"` // bang-bang or pid
+	Steering         PIDConfig `json:"steering"`      // Gains for pid steering
+	TurnSlowdown     float64   `json:"turn_slowdown"` // Fraction of forward_speed given up at the sharpest pid turn
+}
+
+// DetectionSettings holds the tunable parts of ColorDetectionConfig
+type DetectionSettings struct {
+	CenterWidth     int              `json:"center_width"` // Center region is 1/CenterWidth of the frame width
+	MinContourArea  float64          `json:"min_contour_area"`
+	MorphKernelSize int              `json:"morph_kernel_size"`
+	Mode            string           `json:"mode"` // blob or line
+	Line            LineFollowConfig `json:"line"` // Settings for line mode
+}
+
+// Config holds everything jrkbr can be configured with, loaded from a JSON file
+type Config struct {
+	Server       ServerConfig        `json:"server"`
+	Serial       SerialConfig        `json:"serial"`
+	Camera       CameraConfig        `json:"camera"`
+	Tracker      TrackerSettings     `json:"tracker"`
+	Detection    DetectionSettings   `json:"detection"`
+	Record       RecordConfig        `json:"record"`
+	Safety       SafetyConfig        `json:"safety"`
+	Battery      BatteryConfig       `json:"battery"`
+	Colors       map[string]HSVRange `json:"colors"`        // Named color presets for /seekColor
+	DefaultColor string              `json:"default_color"` // Preset used when no color is requested
+}
+
+// DefaultConfig returns the settings used when no config file is given
+func DefaultConfig() Config {
+	tracker := DefaultColorTrackerConfig()
+	detector := tracker.DetectorConfig
+
+	return Config{
+		Server: ServerConfig{Address: ":8080"},
+		Serial: SerialConfig{
+			Baud:        115200,
+			ProbeBaud:   true,
+			Mode:        "full",
+			MotionLease: durationOf(DefaultMotionLease),
+		},
+		Camera: CameraConfig{
+			ID:         detector.CameraID,
+			ShowWindow: detector.ShowWindow,
+			WindowName: detector.WindowName,
+		},
+		Tracker: TrackerSettings{
+			MaxRotationSpeed: tracker.MaxRotationSpeed,
+			MinRotationSpeed: tracker.MinRotationSpeed,
+			ForwardSpeed:     tracker.ForwardSpeed,
+			UpdateInterval:   durationOf(tracker.UpdateInterval),
+			StopDelay:        durationOf(tracker.StopDelay),
+			MaxSearchTime:    durationOf(tracker.MaxSearchTime),
+			SteeringMode:     string(tracker.SteeringMode),
+			Steering:         tracker.Steering,
+			TurnSlowdown:     tracker.TurnSlowdown,
+		},
+		Detection: DetectionSettings{
+			CenterWidth:     detector.CenterWidth,
+			MinContourArea:  detector.MinContourArea,
+			MorphKernelSize: detector.MorphKernelSize,
+			Mode:            string(detector.Mode),
+			Line:            detector.Line,
+		},
+		Record:       RecordConfig{Format: string(RecordPNG)},
+		Safety:       DefaultSafetyConfig(),
+		Battery:      DefaultBatteryConfig(),
+		Colors:       DefaultColorPresets(),
+		DefaultColor: "lime",
+	}
+}
+
+// DefaultColorPresets returns the built-in colors. Red wraps around in HSV, only its lower end is used.
+func DefaultColorPresets() map[string]HSVRange {
+	return map[string]HSVRange{
+		"red":    {Lower: [3]float64{0, 100, 100}, Upper: [3]float64{10, 255, 255}},
+		"blue":   {Lower: [3]float64{100, 100, 100}, Upper: [3]float64{130, 255, 255}},
+		"yellow": {Lower: [3]float64{20, 100, 100}, Upper: [3]float64{30, 255, 255}},
+		"black":  {Lower: [3]float64{0, 0, 0}, Upper: [3]float64{180, 255, 50}},
+		"lime":   {Lower: [3]float64{45, 100, 100}, Upper: [3]float64{65, 255, 255}},
+		"green":  {Lower: [3]float64{35, 100, 100}, Upper: [3]float64{50, 255, 255}},
+	}
+}
+
+// LoadConfig reads a JSON config file over the defaults, so the file only needs the settings
+// it changes. Unknown fields are an error to catch typos. The result is not validated.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	// A file listing colors replaces the built-in presets rather than adding to them
+	var colors struct {
+		Colors json.RawMessage `json:"colors"`
+	}
+	if json.Unmarshal(data, &colors) == nil && colors.Colors != nil {
+		cfg.Colors = nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %s", path, describeJSONError(data, err))
+	}
+	return cfg, nil
+}
+
+// describeJSONError points at the field or line a decoding error comes from
+func describeJSONError(data []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+		return fmt.Sprintf("line %d: %v", line, syntaxErr)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		expected := typeErr.Type.String()
+		if typeErr.Type == reflect.TypeOf(Duration("")) {
+			expected = "a duration such as \"300ms\""
+		}
+		return fmt.Sprintf("%s: expected %s, got %s", typeErr.Field, expected, typeErr.Value)
+	default:
+		return err.Error()
+	}
+}
+
+// ConfigError is a problem with one config setting
+type ConfigError struct {
+	Field   string // Setting path as written in the config file, e.g. tracker.forward_speed
+	Message string
+}
+
+// Error returns the field and what is wrong with it
+func (ce *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", ce.Field, ce.Message)
+}
+
+// Validate checks every setting and returns an error naming each one that is wrong
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	checkDuration := func(field string, value Duration, allowZero bool) {
+		d, err := time.ParseDuration(string(value))
+		switch {
+		case err != nil:
+			fail(field, "expected a duration such as \"300ms\", got %q", value)
+		case d < 0:
+			fail(field, "must not be negative, got %v", d)
+		case d == 0 && !allowZero:
+			fail(field, "must be positive, got %v", d)
+		}
+	}
+
+	if c.Server.Address == "" {
+		fail("server.address", "must not be empty")
+	}
+
+	if _, ok := baudCodes[c.Serial.Baud]; !ok {
+		fail("serial.baud", "unsupported baud rate %d, expected one of %s", c.Serial.Baud, supportedBaudRates())
+	}
+	if mode, err := ParseOIMode(c.Serial.Mode); err != nil {
+		fail("serial.mode", "%v", err)
+	} else if mode != OIModeSafe && mode != OIModeFull {
+		fail("serial.mode", "must be safe or full, got %q", c.Serial.Mode)
+	}
+	checkDuration("serial.motion_lease", c.Serial.MotionLease, true)
+
+	if c.Camera.ID < 0 {
+		fail("camera.id", "must not be negative, got %d", c.Camera.ID)
+	}
+	if source := c.Camera.Source; source != "" && source != SyntheticSourceName && !isStreamURL(source) {
+		if _, err := strconv.Atoi(source); err != nil {
+			if _, err := os.Stat(source); err != nil {
+				fail("camera.source", "%v", err)
+			}
+		}
+	}
+
+	t := c.Tracker
+	checkSpeed := func(field string, speed int16) {
+		if speed <= 0 || speed > MaxVelocity {
+			fail(field, "must be between 1 and %d mm/s, got %d", MaxVelocity, speed)
+		}
+	}
+	checkSpeed("tracker.max_rotation_speed", t.MaxRotationSpeed)
+	checkSpeed("tracker.min_rotation_speed", t.MinRotationSpeed)
+	checkSpeed("tracker.forward_speed", t.ForwardSpeed)
+	if t.MinRotationSpeed > t.MaxRotationSpeed {
+		fail("tracker.min_rotation_speed", "must not exceed max_rotation_speed (%d), got %d", t.MaxRotationSpeed, t.MinRotationSpeed)
+	}
+	checkDuration("tracker.update_interval", t.UpdateInterval, false)
+	checkDuration("tracker.stop_delay", t.StopDelay, true)
+	checkDuration("tracker.max_search_time", t.MaxSearchTime, false)
+	if _, err := ParseSteeringMode(t.SteeringMode); err != nil {
+		fail("tracker.steering_mode", "%v", err)
+	}
+	for _, gain := range []struct {
+		field string
+		value float64
+	}{
+		{"tracker.steering.kp", t.Steering.Kp},
+		{"tracker.steering.ki", t.Steering.Ki},
+		{"tracker.steering.kd", t.Steering.Kd},
+		{"tracker.steering.integral_limit", t.Steering.IntegralLimit},
+	} {
+		if gain.value < 0 {
+			fail(gain.field, "must not be negative, got %v", gain.value)
+		}
+	}
+	if limit := t.Steering.OutputLimit; limit < 0 || limit > float64(MaxVelocity) {
+		fail("tracker.steering.output_limit", "must be between 0 and %d mm/s, got %v", MaxVelocity, limit)
+	}
+	if t.TurnSlowdown < 0 || t.TurnSlowdown > 1 {
+		fail("tracker.turn_slowdown", "must be between 0 and 1, got %v", t.TurnSlowdown)
+	}
+
+	d := c.Detection
+	if d.CenterWidth < 1 {
+		fail("detection.center_width", "must be at least 1, got %d", d.CenterWidth)
+	}
+	if d.MinContourArea < 0 {
+		fail("detection.min_contour_area", "must not be negative, got %v", d.MinContourArea)
+	}
+	if d.MorphKernelSize < 1 {
+		fail("detection.morph_kernel_size", "must be at least 1, got %d", d.MorphKernelSize)
+	}
+	if _, err := ParseDetectionMode(d.Mode); err != nil {
+		fail("detection.mode", "%v", err)
+	}
+	if d.Line.Bands < 1 {
+		fail("detection.line.bands", "must be at least 1, got %d", d.Line.Bands)
+	}
+	for _, fraction := range []struct {
+		field string
+		value float64
+	}{
+		{"detection.line.lookahead", d.Line.Lookahead},
+		{"detection.line.min_band_fill", d.Line.MinBandFill},
+		{"detection.line.intersection_width", d.Line.IntersectionWidth},
+	} {
+		if fraction.value <= 0 || fraction.value > 1 {
+			fail(fraction.field, "must be above 0 and at most 1, got %v", fraction.value)
+		}
+	}
+
+	if _, err := ParseRecordFormat(c.Record.Format); err != nil {
+		fail("record.format", "%v", err)
+	}
+
+	if c.Safety.BackoffDistance < 0 {
+		fail("safety.backoff_distance", "must not be negative, got %d", c.Safety.BackoffDistance)
+	} else if c.Safety.BackoffDistance > 0 {
+		checkSpeed("safety.backoff_speed", c.Safety.BackoffSpeed)
+	}
+
+	b := c.Battery
+	for _, percent := range []struct {
+		field string
+		value float64
+	}{
+		{"battery.low_percent", b.LowPercent},
+		{"battery.critical_percent", b.CriticalPercent},
+		{"battery.min_start_percent", b.MinStartPercent},
+	} {
+		if percent.value < 0 || percent.value > 100 {
+			fail(percent.field, "must be between 0 and 100, got %v", percent.value)
+		}
+	}
+	if b.CriticalPercent >= b.LowPercent {
+		fail("battery.critical_percent", "must be below low_percent (%v), got %v", b.LowPercent, b.CriticalPercent)
+	}
+	if b.Hysteresis < 0 {
+		fail("battery.hysteresis", "must not be negative, got %v", b.Hysteresis)
+	}
+
+	if len(c.Colors) == 0 {
+		fail("colors", "must define at least one color")
+	}
+	for _, name := range c.ColorNames() {
+		errs = append(errs, c.Colors[name].validate("colors."+name)...)
+	}
+	if _, ok := c.Colors[c.DefaultColor]; !ok && len(c.Colors) > 0 {
+		fail("default_color", "%q is not one of the colors (%s)", c.DefaultColor, strings.Join(c.ColorNames(), ", "))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the bounds are within the OpenCV HSV ranges and in order
+func (hr HSVRange) validate(field string) []error {
+	var errs []error
+	channels := [3]string{"hue", "saturation", "value"}
+	limits := [3]float64{180, 255, 255}
+
+	for i, channel := range channels {
+		for _, bound := range []struct {
+			name  string
+			value float64
+		}{{"lower", hr.Lower[i]}, {"upper", hr.Upper[i]}} {
+			if bound.value < 0 || bound.value > limits[i] {
+				errs = append(errs, &ConfigError{
+					Field:   fmt.Sprintf("%s.%s[%d]", field, bound.name, i),
+					Message: fmt.Sprintf("%s must be between 0 and %v, got %v", channel, limits[i], bound.value),
+				})
+			}
+		}
+		if hr.Lower[i] > hr.Upper[i] {
+			errs = append(errs, &ConfigError{
+				Field:   fmt.Sprintf("%s.lower[%d]", field, i),
+				Message: fmt.Sprintf("%s %v is above the upper bound %v", channel, hr.Lower[i], hr.Upper[i]),
+			})
+		}
+	}
+	return errs
+}
+
+// ColorNames returns the preset names in alphabetical order
+func (c Config) ColorNames() []string {
+	names := make([]string, 0, len(c.Colors))
+	for name := range c.Colors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TrackerConfig builds the color tracker settings for the named preset,
+// or the default color if the name is empty
+func (c Config) TrackerConfig(colorName string) (ColorTrackerConfig, error) {
+	if colorName == "" {
+		colorName = c.DefaultColor
+	}
+	preset, ok := c.Colors[colorName]
+	if !ok {
+		return ColorTrackerConfig{}, fmt.Errorf("unknown color %q, choose one of %s", colorName, strings.Join(c.ColorNames(), ", "))
+	}
+
+	config := DefaultColorTrackerConfig()
+	config.MaxRotationSpeed = c.Tracker.MaxRotationSpeed
+	config.MinRotationSpeed = c.Tracker.MinRotationSpeed
+	config.ForwardSpeed = c.Tracker.ForwardSpeed
+	config.UpdateInterval = c.Tracker.UpdateInterval.Value()
+	config.StopDelay = c.Tracker.StopDelay.Value()
+	config.MaxSearchTime = c.Tracker.MaxSearchTime.Value()
+	config.SteeringMode = SteeringMode(c.Tracker.SteeringMode)
+	config.Steering = c.Tracker.Steering
+	config.TurnSlowdown = c.Tracker.TurnSlowdown
+
+	config.RecordDir = c.Record.Dir
+	config.RecordFormat = RecordFormat(c.Record.Format)
+
+	detector := &config.DetectorConfig
+	detector.LowerHSVBound = gocv.NewScalar(preset.Lower[0], preset.Lower[1], preset.Lower[2], 0)
+	detector.UpperHSVBound = gocv.NewScalar(preset.Upper[0], preset.Upper[1], preset.Upper[2], 0)
+	detector.CenterWidth = c.Detection.CenterWidth
+	detector.MinContourArea = c.Detection.MinContourArea
+	detector.MorphKernelSize = c.Detection.MorphKernelSize
+	detector.Mode = DetectionMode(c.Detection.Mode)
+	detector.Line = c.Detection.Line
+	detector.CameraID = c.Camera.ID
+	detector.Source = c.Camera.Source
+	detector.LoopSource = c.Camera.Loop
+	detector.ShowWindow = c.Camera.ShowWindow
+	detector.WindowName = c.Camera.WindowName
+	return config, nil
+}
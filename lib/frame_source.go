@@ -0,0 +1,356 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	DefaultImageFrameInterval     = 100 * time.Millisecond // Pace of an image directory, 10 frames per second
+	DefaultSyntheticFrameInterval = 33 * time.Millisecond  // Pace of the synthetic source, about 30 frames per second
+	defaultVideoFPS               = 30                     // Used when a video file doesn't report its frame rate
+	streamReconnectAfter          = 100                    // Failed reads before a stream is reopened
+)
+
+// SyntheticSourceName selects the generated test pattern in OpenFrameSource
+const SyntheticSourceName = "synthetic"
+
+var (
+	// ErrNoFrame means no frame was ready, the caller should try again shortly
+	ErrNoFrame = errors.New("no frame available")
+	// ErrEndOfFrames means a file or directory source has run out of frames
+	ErrEndOfFrames = errors.New("end of frames")
+)
+
+// FrameSource supplies BGR frames to the color detector.
+// A webcam, a recorded video and a directory of stills all look the same to detectionLoop.
+type FrameSource interface {
+	// Read stores the next frame in dst, waiting to keep the source's frame rate
+	Read(dst *gocv.Mat) error
+	Close() error
+}
+
+// OpenFrameSource opens a frame source by name: a camera index such as 0, an rtsp:// or http://
+// stream URL, "synthetic" for a generated test pattern, a directory of images or a video file.
+// File and directory sources start over at the end when loop is set.
+func OpenFrameSource(name string, loop bool) (FrameSource, error) {
+	switch {
+	case name == "":
+		return nil, fmt.Errorf("no frame source given")
+	case name == SyntheticSourceName:
+		return NewSyntheticSource(640, 480, color.RGBA{R: 110, G: 255, B: 0, A: 0}), nil
+	case isStreamURL(name):
+		return OpenStreamSource(name)
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		return OpenCameraSource(id)
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open frame source: %v", err)
+	}
+	if info.IsDir() {
+		source, err := OpenImageDirSource(name)
+		if err != nil {
+			return nil, err
+		}
+		source.Loop = loop
+		return source, nil
+	}
+
+	source, err := OpenVideoFileSource(name)
+	if err != nil {
+		return nil, err
+	}
+	source.Loop = loop
+	return source, nil
+}
+
+// isStreamURL reports whether the name is a network stream rather than a local path
+func isStreamURL(name string) bool {
+	for _, prefix := range []string{"rtsp://", "http://", "https://"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// framePacer holds a source to a steady frame rate
+type framePacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// wait sleeps until the next frame is due
+func (fp *framePacer) wait() {
+	if fp.interval <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if fp.next.After(now) {
+		time.Sleep(fp.next.Sub(now))
+	} else if now.Sub(fp.next) > fp.interval {
+		// Fell behind, don't rush to catch up
+		fp.next = now
+	}
+	fp.next = fp.next.Add(fp.interval)
+}
+
+// CameraSource reads frames from a local camera, e.g. /dev/video0 for index 0
+type CameraSource struct {
+	capture *gocv.VideoCapture
+}
+
+// OpenCameraSource opens the camera with the given index
+func OpenCameraSource(id int) (*CameraSource, error) {
+	capture, err := gocv.OpenVideoCapture(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open camera %d: %v", id, err)
+	}
+	return &CameraSource{capture: capture}, nil
+}
+
+// Read waits for the next frame from the camera
+func (cs *CameraSource) Read(dst *gocv.Mat) error {
+	if ok := cs.capture.Read(dst); !ok || dst.Empty() {
+		return ErrNoFrame
+	}
+	return nil
+}
+
+// Close releases the camera
+func (cs *CameraSource) Close() error {
+	return cs.capture.Close()
+}
+
+// VideoFileSource plays a recorded video file at its own frame rate
+type VideoFileSource struct {
+	Loop    bool // Start over at the end instead of returning ErrEndOfFrames
+	path    string
+	capture *gocv.VideoCapture
+	pacer   framePacer
+}
+
+// OpenVideoFileSource opens a video file
+func OpenVideoFileSource(path string) (*VideoFileSource, error) {
+	capture, err := gocv.VideoCaptureFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video %s: %v", path, err)
+	}
+
+	fps := capture.Get(gocv.VideoCaptureFPS)
+	if fps <= 0 || math.IsNaN(fps) {
+		fps = defaultVideoFPS
+	}
+
+	return &VideoFileSource{
+		path:    path,
+		capture: capture,
+		pacer:   framePacer{interval: time.Duration(float64(time.Second) / fps)},
+	}, nil
+}
+
+// Read returns the next frame of the video
+func (vs *VideoFileSource) Read(dst *gocv.Mat) error {
+	vs.pacer.wait()
+
+	if ok := vs.capture.Read(dst); ok && !dst.Empty() {
+		return nil
+	}
+	if !vs.Loop {
+		return ErrEndOfFrames
+	}
+
+	// Rewind and try once more, a video that can't be read from the start is broken
+	vs.capture.Set(gocv.VideoCapturePosFrames, 0)
+	if ok := vs.capture.Read(dst); !ok || dst.Empty() {
+		return fmt.Errorf("failed to read video %s", vs.path)
+	}
+	return nil
+}
+
+// Close closes the video file
+func (vs *VideoFileSource) Close() error {
+	return vs.capture.Close()
+}
+
+// ImageDirSource plays the images in a directory in name order, e.g. frame_0001.jpg, frame_0002.jpg
+type ImageDirSource struct {
+	Loop  bool // Start over at the end instead of returning ErrEndOfFrames
+	files []string
+	next  int
+	pacer framePacer
+}
+
+// imageExtensions are the still formats read from an image directory
+var imageExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".bmp": true}
+
+// OpenImageDirSource lists the images in a directory, played at DefaultImageFrameInterval
+func OpenImageDirSource(dir string) (*ImageDirSource, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image directory: %v", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !imageExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no images in %s", dir)
+	}
+	sort.Strings(files)
+
+	return &ImageDirSource{
+		files: files,
+		pacer: framePacer{interval: DefaultImageFrameInterval},
+	}, nil
+}
+
+// SetInterval changes how long each image is shown
+func (is *ImageDirSource) SetInterval(interval time.Duration) {
+	is.pacer.interval = interval
+}
+
+// Read loads the next image
+func (is *ImageDirSource) Read(dst *gocv.Mat) error {
+	if is.next >= len(is.files) {
+		if !is.Loop {
+			return ErrEndOfFrames
+		}
+		is.next = 0
+	}
+	is.pacer.wait()
+
+	path := is.files[is.next]
+	is.next++
+
+	img := gocv.IMRead(path, gocv.IMReadColor)
+	defer img.Close()
+	if img.Empty() {
+		return fmt.Errorf("failed to read image %s", path)
+	}
+	img.CopyTo(dst)
+	return nil
+}
+
+// Close does nothing, images are only open while being read
+func (is *ImageDirSource) Close() error {
+	return nil
+}
+
+// StreamSource reads an RTSP or MJPEG-over-HTTP stream, reopening it if it stops delivering frames
+type StreamSource struct {
+	url      string
+	capture  *gocv.VideoCapture
+	failures int
+}
+
+// OpenStreamSource connects to a stream URL
+func OpenStreamSource(url string) (*StreamSource, error) {
+	capture, err := gocv.OpenVideoCapture(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream %s: %v", url, err)
+	}
+	return &StreamSource{url: url, capture: capture}, nil
+}
+
+// Read waits for the next frame from the stream
+func (ss *StreamSource) Read(dst *gocv.Mat) error {
+	if ss.capture != nil {
+		if ok := ss.capture.Read(dst); ok && !dst.Empty() {
+			ss.failures = 0
+			return nil
+		}
+	}
+
+	ss.failures++
+	if ss.failures < streamReconnectAfter {
+		return ErrNoFrame
+	}
+
+	// The camera may have rebooted or the network dropped, start a fresh connection
+	ss.failures = 0
+	if ss.capture != nil {
+		ss.capture.Close()
+		ss.capture = nil
+	}
+	capture, err := gocv.OpenVideoCapture(ss.url)
+	if err != nil {
+		return fmt.Errorf("failed to reopen stream %s: %v", ss.url, err)
+	}
+	ss.capture = capture
+	return ErrNoFrame
+}
+
+// Close disconnects from the stream
+func (ss *StreamSource) Close() error {
+	if ss.capture == nil {
+		return nil
+	}
+	return ss.capture.Close()
+}
+
+// SyntheticSource draws a strip of tape sweeping left and right across a gray floor.
+// It needs no camera or files, and the same frame number always gives the same image.
+type SyntheticSource struct {
+	Width  int
+	Height int
+	Color  color.RGBA    // Tape color
+	Period time.Duration // Time for one sweep left and back
+	frame  int
+	pacer  framePacer
+}
+
+// NewSyntheticSource creates a synthetic source of the given size and tape color
+func NewSyntheticSource(width, height int, tape color.RGBA) *SyntheticSource {
+	return &SyntheticSource{
+		Width:  width,
+		Height: height,
+		Color:  tape,
+		Period: 4 * time.Second,
+		pacer:  framePacer{interval: DefaultSyntheticFrameInterval},
+	}
+}
+
+// Read draws the next frame
+func (ss *SyntheticSource) Read(dst *gocv.Mat) error {
+	ss.pacer.wait()
+
+	// Position follows the frame count rather than the clock so replays are repeatable
+	elapsed := time.Duration(ss.frame) * DefaultSyntheticFrameInterval
+	ss.frame++
+	phase := 2 * math.Pi * float64(elapsed%ss.Period) / float64(ss.Period)
+
+	stripWidth := ss.Width / 8
+	center := ss.Width/2 + int(float64(ss.Width-stripWidth)/2*math.Sin(phase))
+
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(90, 90, 90, 0), ss.Height, ss.Width, gocv.MatTypeCV8UC3)
+	defer img.Close()
+	gocv.Rectangle(&img, image.Rect(center-stripWidth/2, ss.Height/3, center+stripWidth/2, ss.Height), ss.Color, -1)
+	img.CopyTo(dst)
+	return nil
+}
+
+// Close does nothing
+func (ss *SyntheticSource) Close() error {
+	return nil
+}
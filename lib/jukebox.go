@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrUnknownSong is returned when playing a song that was never loaded
+	ErrUnknownSong = errors.New("unknown song")
+	// ErrSongPlaying is returned when a song is requested while another one is still playing
+	ErrSongPlaying = errors.New("another song is playing")
+)
+
+// Jukebox keeps named melodies in the Roomba's song slots, handing out slots in order
+type Jukebox struct {
+	roomba   *Roomba
+	songs    map[string]StoredMelody
+	nextSlot int
+	playing  bool
+	mu       sync.Mutex
+}
+
+// NewJukebox creates an empty jukebox using all of the Roomba's song slots
+func NewJukebox(roomba *Roomba) *Jukebox {
+	return &Jukebox{
+		roomba: roomba,
+		songs:  make(map[string]StoredMelody),
+	}
+}
+
+// Load parses a melody in ParseMelody notation and stores it under the given name
+func (j *Jukebox) Load(name, melody string) error {
+	notes, err := ParseMelody(melody)
+	if err != nil {
+		return fmt.Errorf("song %q: %v", name, err)
+	}
+	return j.Add(name, notes)
+}
+
+// Add stores notes under the given name in the next free song slots
+func (j *Jukebox) Add(name string, notes []Note) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.songs[name]; exists {
+		return fmt.Errorf("song %q already loaded", name)
+	}
+	if j.nextSlot > int(MaxSongSlot) {
+		return fmt.Errorf("song %q: all %d song slots are in use", name, int(MaxSongSlot)+1)
+	}
+
+	stored, err := j.roomba.DefineMelody(byte(j.nextSlot), notes)
+	if err != nil {
+		return fmt.Errorf("song %q: %v", name, err)
+	}
+	j.songs[name] = stored
+	j.nextSlot += len(stored.Slots)
+	return nil
+}
+
+// Names returns the loaded song names in alphabetical order
+func (j *Jukebox) Names() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	names := make([]string, 0, len(j.songs))
+	for name := range j.songs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether a song is loaded under the given name
+func (j *Jukebox) Has(name string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.songs[name]
+	return ok
+}
+
+// Play starts playing a song in the background.
+// Songs don't queue: ErrSongPlaying is returned while another song is still playing.
+func (j *Jukebox) Play(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	melody, ok := j.songs[name]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownSong, name)
+	}
+	if j.playing {
+		return ErrSongPlaying
+	}
+	j.playing = true
+
+	go func() {
+		if err := j.roomba.PlayMelody(context.Background(), melody); err != nil {
+			log.Printf("Error playing song %q: %v", name, err)
+		}
+
+		j.mu.Lock()
+		j.playing = false
+		j.mu.Unlock()
+	}()
+	return nil
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultLEDRefreshInterval is how often the indicator updates pulsing and flashing LEDs
+const DefaultLEDRefreshInterval = 100 * time.Millisecond
+
+// RobotState is what the robot is doing, as shown on its LEDs
+type RobotState int
+
+const (
+	StateIdle      RobotState = iota // Waiting for a command
+	StateSearching                   // Looking for the color
+	StateTracking                    // Following the color
+	StateError                       // Something needs attention from staff
+)
+
+// String returns the state name
+func (rs RobotState) String() string {
+	switch rs {
+	case StateIdle:
+		return "idle"
+	case StateSearching:
+		return "searching"
+	case StateTracking:
+		return "tracking"
+	case StateError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(rs))
+	}
+}
+
+// LEDEffect is how a pattern changes over time
+type LEDEffect int
+
+const (
+	LEDSteady LEDEffect = iota // Always on
+	LEDPulse                   // Power LED fades up and down
+	LEDFlash                   // All LEDs blink on and off
+)
+
+// LEDPattern is how the LEDs look in one robot state
+type LEDPattern struct {
+	Bits       LEDBits       // LEDs to light, e.g. LEDStatusGreen
+	PowerColor byte          // Power LED color from green (0) to red (255)
+	Intensity  byte          // Peak power LED intensity
+	Effect     LEDEffect     // Steady, pulsing or flashing
+	Period     time.Duration // Length of one pulse or flash cycle
+}
+
+// DefaultLEDPatterns returns the standard state colors: tracking shows green,
+// searching pulses amber and errors flash red
+func DefaultLEDPatterns() map[RobotState]LEDPattern {
+	return map[RobotState]LEDPattern{
+		StateIdle:      {Bits: LEDsOff, PowerColor: PowerColorGreen, Intensity: 64, Effect: LEDSteady},
+		StateSearching: {Bits: LEDStatusAmber, PowerColor: PowerColorAmber, Intensity: 255, Effect: LEDPulse, Period: 1500 * time.Millisecond},
+		StateTracking:  {Bits: LEDStatusGreen, PowerColor: PowerColorGreen, Intensity: 255, Effect: LEDSteady},
+		StateError:     {Bits: LEDStatusRed, PowerColor: PowerColorRed, Intensity: 255, Effect: LEDFlash, Period: 500 * time.Millisecond},
+	}
+}
+
+// ledFrame is the argument set of one SetLEDs call
+type ledFrame struct {
+	bits       LEDBits
+	powerColor byte
+	intensity  byte
+}
+
+// at returns the LED settings of the pattern at the given time into its cycle
+func (p LEDPattern) at(elapsed time.Duration) ledFrame {
+	frame := ledFrame{bits: p.Bits, powerColor: p.PowerColor, intensity: p.Intensity}
+	if p.Period <= 0 {
+		return frame
+	}
+
+	phase := float64(elapsed%p.Period) / float64(p.Period)
+	switch p.Effect {
+	case LEDPulse:
+		// Triangle wave from off to peak and back
+		frame.intensity = byte(math.Round(float64(p.Intensity) * (1 - math.Abs(2*phase-1))))
+	case LEDFlash:
+		if phase >= 0.5 {
+			frame.bits = LEDsOff
+			frame.intensity = 0
+		}
+	}
+	return frame
+}
+
+// LEDIndicator shows the robot state on the status and power LEDs so staff can read it
+// without looking at the face screen. A fault overrides the state with the error pattern
+// until it is cleared.
+type LEDIndicator struct {
+	roomba   *Roomba
+	patterns map[RobotState]LEDPattern
+	interval time.Duration
+	state    RobotState
+	fault    bool
+	since    time.Time // When the shown pattern started, so cycles begin at the start
+	last     *ledFrame // Last frame sent, nil to force a refresh
+	lastErr  error
+	failures failureLog
+	running  bool
+	mu       sync.Mutex
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewLEDIndicator creates an indicator using the given patterns, falling back to
+// the default pattern for any state that is missing
+func NewLEDIndicator(roomba *Roomba, patterns map[RobotState]LEDPattern) *LEDIndicator {
+	merged := DefaultLEDPatterns()
+	for state, pattern := range patterns {
+		merged[state] = pattern
+	}
+
+	return &LEDIndicator{
+		roomba:   roomba,
+		patterns: merged,
+		interval: DefaultLEDRefreshInterval,
+		state:    StateIdle,
+		since:    time.Now(),
+		failures: failureLog{prefix: "Error updating LEDs"},
+	}
+}
+
+// Start begins updating the LEDs in a separate goroutine
+func (li *LEDIndicator) Start() {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	if li.running {
+		return
+	}
+	li.running = true
+	li.last = nil
+	li.stopChan = make(chan struct{})
+	li.doneChan = make(chan struct{})
+
+	go li.refreshLoop(li.stopChan, li.doneChan)
+}
+
+// Stop stops updating the LEDs and turns them off
+func (li *LEDIndicator) Stop() {
+	li.mu.Lock()
+	if !li.running {
+		li.mu.Unlock()
+		return
+	}
+	li.running = false
+	close(li.stopChan)
+	done := li.doneChan
+	li.mu.Unlock()
+
+	<-done
+
+	if err := li.roomba.SetLEDs(LEDsOff, PowerColorGreen, 0); err != nil {
+		log.Printf("Error turning off LEDs: %v", err)
+	}
+}
+
+// SetState changes the state shown when there is no fault
+func (li *LEDIndicator) SetState(state RobotState) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	if li.state == state {
+		return
+	}
+	li.state = state
+	if !li.fault {
+		li.since = time.Now()
+	}
+}
+
+// SetFault shows the error pattern until cleared, whatever the state
+func (li *LEDIndicator) SetFault(fault bool) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	if li.fault == fault {
+		return
+	}
+	li.fault = fault
+	li.since = time.Now()
+}
+
+// State returns the state currently shown, StateError while a fault is set
+func (li *LEDIndicator) State() RobotState {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	if li.fault {
+		return StateError
+	}
+	return li.state
+}
+
+// refreshLoop sends the LED settings for the current state whenever they change
+func (li *LEDIndicator) refreshLoop(stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	ticker := time.NewTicker(li.interval)
+	defer ticker.Stop()
+
+	li.refresh()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			li.refresh()
+		}
+	}
+}
+
+// refresh computes the current LED settings and sends them if they differ from the last ones
+func (li *LEDIndicator) refresh() {
+	li.mu.Lock()
+	state := li.state
+	if li.fault {
+		state = StateError
+	}
+	frame := li.patterns[state].at(time.Since(li.since))
+	if li.last != nil && *li.last == frame {
+		li.mu.Unlock()
+		return
+	}
+	li.mu.Unlock()
+
+	err := li.roomba.SetLEDs(frame.bits, frame.powerColor, frame.intensity)
+
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if err != nil {
+		li.failures.fail(err)
+		li.lastErr = err
+		return
+	}
+	li.failures.ok()
+	li.lastErr = nil
+	li.last = &frame
+}
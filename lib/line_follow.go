@@ -0,0 +1,308 @@
+package lib
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// DetectionMode is what the detector looks for in the color mask
+type DetectionMode string
+
+const (
+	DetectBlob DetectionMode = "blob" // The largest patch of the color, e.g. a card held up to the camera
+	DetectLine DetectionMode = "line" // A line of tape on the floor, traced through the bands of LineFollowConfig
+)
+
+// ParseDetectionMode returns the detection mode with the given name
+func ParseDetectionMode(name string) (DetectionMode, error) {
+	switch mode := DetectionMode(name); mode {
+	case DetectBlob, DetectLine:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown detection mode %q, expected blob or line", name)
+	}
+}
+
+// LineFollowConfig holds the settings for tracing a line of tape in DetectLine mode
+type LineFollowConfig struct {
+	Bands             int     `json:"bands"`              // Horizontal bands the lookahead region is sliced into
+	Lookahead         float64 `json:"lookahead"`          // Fraction of the frame height, from the bottom, searched for the line
+	MinBandFill       float64 `json:"min_band_fill"`      // Fraction of a band's height a column must cover to count as line
+	IntersectionWidth float64 `json:"intersection_width"` // Line wider than this fraction of the frame is a crossing line
+}
+
+// DefaultLineFollowConfig returns settings for tape about 5cm wide seen by a camera looking down and ahead
+func DefaultLineFollowConfig() LineFollowConfig {
+	return LineFollowConfig{
+		Bands:             6,
+		Lookahead:         0.6, // The lower 60% of the frame, the top is too far ahead to steer by
+		MinBandFill:       0.3,
+		IntersectionWidth: 0.4,
+	}
+}
+
+// LineBand is what one band of the lookahead region shows
+type LineBand struct {
+	Rect         image.Rectangle // Band in frame pixels
+	Found        bool            // Whether the line crosses the band
+	Center       image.Point     // Middle of the line within the band
+	Width        int             // Width of the line in pixels
+	Intersection bool            // Crossing or branching lines, left out of the fit
+}
+
+// LineResult describes the line ahead of the robot
+type LineResult struct {
+	Bands        []LineBand // Nearest band first
+	Visible      int        // Bands the line was found in
+	Offset       float64    // Where the line meets the bottom of the frame, -1 at the left edge to 1 at the right
+	Heading      float64    // Angle of the line from straight ahead in radians, positive leaning right
+	Curvature    float64    // How the line bends further ahead, positive bending right
+	Ahead        float64    // Where the line is halfway up the lookahead region, what the tracker steers toward
+	Intersection bool       // The line crosses or branches off another line
+	End          bool       // The line stops within the lookahead region rather than leaving the frame
+}
+
+// lineRun is a stretch of neighboring columns covered by the line
+type lineRun struct {
+	start, end int // First and last column
+}
+
+// width returns how many columns the run covers
+func (lr lineRun) width() int {
+	return lr.end - lr.start + 1
+}
+
+// center returns the middle column of the run
+func (lr lineRun) center() int {
+	return (lr.start + lr.end) / 2
+}
+
+// analyzeLine traces the line through the bands of the lookahead region of buf.mask
+// and fills in the result, steering toward the line halfway up the region
+func (cd *ColorDetector) analyzeLine(buf *detectionBuffers, result *DetectionResult) {
+	width := buf.mask.Cols()
+	height := buf.mask.Rows()
+	config := cd.Config.Line
+
+	// Sum each column of each band, nearest band first
+	bandHeight := int(float64(height)*config.Lookahead) / config.Bands
+	if bandHeight < 1 {
+		return
+	}
+	rects := make([]image.Rectangle, config.Bands)
+	profiles := make([][]int, config.Bands)
+	for i := range rects {
+		rects[i] = image.Rect(0, height-(i+1)*bandHeight, width, height-i*bandHeight)
+
+		region := buf.mask.Region(rects[i])
+		gocv.Reduce(region, &buf.profile, 0, gocv.ReduceSum, gocv.MatTypeCV32S)
+		region.Close()
+
+		profiles[i] = make([]int, width)
+		for x := range profiles[i] {
+			profiles[i][x] = int(buf.profile.GetIntAt(0, x)) / 255
+		}
+	}
+
+	line := traceLine(rects, profiles, width, height, config)
+	result.Line = line
+	if line.Visible == 0 {
+		return
+	}
+
+	// Describe the line like a blob so the rest of the tracker can treat both modes alike
+	result.Found = true
+	result.Offset = line.Ahead
+	aheadY := height - int(float64(height)*config.Lookahead/2)
+	result.Centroid = image.Pt(width/2+int(line.Ahead*float64(width)/2), aheadY)
+	for _, band := range line.Bands {
+		if !band.Found {
+			continue
+		}
+		result.Area += float64(band.Width * band.Rect.Dy())
+		segment := image.Rect(band.Center.X-band.Width/2, band.Rect.Min.Y, band.Center.X+band.Width/2+1, band.Rect.Max.Y)
+		result.Rect = result.Rect.Union(segment)
+	}
+	result.Coverage = result.Area / float64(width*height)
+	result.Confidence = float64(line.Visible) / float64(len(line.Bands))
+
+	switch {
+	case result.Centroid.X >= result.CenterRect.Min.X && result.Centroid.X <= result.CenterRect.Max.X:
+		result.Position = LineCentered
+	case result.Centroid.X < result.CenterRect.Min.X:
+		result.Position = LineLeft
+	default:
+		result.Position = LineRight
+	}
+}
+
+// traceLine follows the line from the nearest band to the farthest, each band picking the stretch
+// of line closest to the one below it, then fits a curve through the band centers
+func traceLine(rects []image.Rectangle, profiles [][]int, width, height int, config LineFollowConfig) LineResult {
+	line := LineResult{Bands: make([]LineBand, len(rects))}
+	expected := width / 2
+	farthest := -1
+	var farthestRun lineRun
+
+	var us, vs []float64
+	for i, rect := range rects {
+		band := LineBand{Rect: rect}
+		runs := columnRuns(profiles[i], int(math.Ceil(config.MinBandFill*float64(rect.Dy()))))
+		if len(runs) == 0 {
+			line.Bands[i] = band
+			continue
+		}
+
+		// The line is the stretch nearest where it was in the band below
+		best := runs[0]
+		for _, run := range runs[1:] {
+			if absInt(run.center()-expected) < absInt(best.center()-expected) {
+				best = run
+			}
+		}
+		band.Found = true
+		band.Width = best.width()
+		band.Center = image.Pt(best.center(), (rect.Min.Y+rect.Max.Y)/2)
+
+		// A line much wider than usual is one crossing ours, and a second stretch about as wide is a branch.
+		// Either way the band's center says nothing about where our line goes, so it stays out of the fit.
+		for _, run := range runs {
+			if run != best && run.width()*2 >= best.width() {
+				band.Intersection = true
+			}
+		}
+		if float64(best.width()) > config.IntersectionWidth*float64(width) {
+			band.Intersection = true
+			band.Center.X = expected
+		}
+
+		line.Bands[i] = band
+		line.Visible++
+		farthest = i
+		farthestRun = best
+		if band.Intersection {
+			line.Intersection = true
+			continue
+		}
+
+		expected = best.center()
+		us = append(us, float64(band.Center.X-width/2)/(float64(width)/2))
+		vs = append(vs, float64(height-band.Center.Y)/float64(height))
+	}
+	if line.Visible == 0 {
+		return line
+	}
+
+	// The line ends ahead if the far bands are empty but it didn't run off the side of the frame on a curve
+	line.End = farthest < len(rects)-1 && farthestRun.start > 0 && farthestRun.end < width-1 && !line.Bands[farthest].Intersection
+
+	// Fit the line as u = a + b*v + c*v², with u across the frame from -1 to 1 and v the distance up from the bottom
+	coeffs := fitPolynomial(vs, us, min(len(us)-1, 2))
+	for len(coeffs) < 3 {
+		coeffs = append(coeffs, 0)
+	}
+	a, b, c := coeffs[0], coeffs[1], coeffs[2]
+	ahead := config.Lookahead / 2
+	line.Offset = clampUnit(a)
+	line.Ahead = clampUnit(a + b*ahead + c*ahead*ahead)
+	line.Heading = math.Atan(b * float64(width) / 2 / float64(height))
+	line.Curvature = 2 * c
+	return line
+}
+
+// columnRuns finds the stretches of neighboring columns with at least threshold line pixels
+func columnRuns(profile []int, threshold int) []lineRun {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	var runs []lineRun
+	inRun := false
+	for x, count := range profile {
+		switch {
+		case count >= threshold && !inRun:
+			runs = append(runs, lineRun{start: x, end: x})
+			inRun = true
+		case count >= threshold:
+			runs[len(runs)-1].end = x
+		default:
+			inRun = false
+		}
+	}
+	return runs
+}
+
+// fitPolynomial fits ys = c0 + c1*x + ... + cn*x^n by least squares and returns the coefficients.
+// It returns fewer coefficients if the points can't support the degree, and none without points.
+func fitPolynomial(xs, ys []float64, degree int) []float64 {
+	for ; degree >= 0; degree-- {
+		if coeffs, ok := solveLeastSquares(xs, ys, degree); ok {
+			return coeffs
+		}
+	}
+	return nil
+}
+
+// solveLeastSquares solves the normal equations of a polynomial fit by Gaussian elimination,
+// reporting false if they are singular, e.g. for fewer distinct points than coefficients
+func solveLeastSquares(xs, ys []float64, degree int) ([]float64, bool) {
+	n := degree + 1
+	if len(xs) < n {
+		return nil, false
+	}
+
+	// Build the augmented matrix of the normal equations
+	m := make([][]float64, n)
+	for row := range m {
+		m[row] = make([]float64, n+1)
+		for col := 0; col < n; col++ {
+			for _, x := range xs {
+				m[row][col] += math.Pow(x, float64(row+col))
+			}
+		}
+		for i, x := range xs {
+			m[row][n] += ys[i] * math.Pow(x, float64(row))
+		}
+	}
+
+	for col := 0; col < n; col++ {
+		// Swap in the row with the largest pivot to keep the arithmetic stable
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			factor := m[row][col] / m[col][col]
+			for k := col; k <= n; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+
+	coeffs := make([]float64, n)
+	for i := range coeffs {
+		coeffs[i] = m[i][n] / m[i][i]
+	}
+	return coeffs, true
+}
+
+// absInt returns the absolute value of an int
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// Size of the frames traced in the tests
+const (
+	testFrameWidth  = 200
+	testFrameHeight = 100
+	testBandHeight  = 10
+)
+
+// testBandRects returns the rectangles of n bands stacked up from the bottom of the frame, nearest first
+func testBandRects(n int) []image.Rectangle {
+	rects := make([]image.Rectangle, n)
+	for i := range rects {
+		bottom := testFrameHeight - i*testBandHeight
+		rects[i] = image.Rect(0, bottom-testBandHeight, testFrameWidth, bottom)
+	}
+	return rects
+}
+
+// testProfile returns a band's column profile with the line filling the given inclusive column ranges
+func testProfile(runs ...[2]int) []int {
+	profile := make([]int, testFrameWidth)
+	for _, run := range runs {
+		for x := run[0]; x <= run[1]; x++ {
+			profile[x] = testBandHeight
+		}
+	}
+	return profile
+}
+
+// approxEqual reports whether two floats agree to within rounding error
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestTraceLine(t *testing.T) {
+	centered := testProfile([2]int{96, 104})
+
+	tests := []struct {
+		name         string
+		profiles     [][]int
+		visible      int
+		offset       float64
+		heading      float64
+		ahead        float64
+		intersection bool
+		end          bool
+		centers      []int // Center column of each band the line was found in
+	}{
+		{
+			name:     "no line",
+			profiles: [][]int{testProfile(), testProfile(), testProfile(), testProfile()},
+		},
+		{
+			name:     "straight ahead",
+			profiles: [][]int{centered, centered, centered, centered},
+			visible:  4,
+			centers:  []int{100, 100, 100, 100},
+		},
+		{
+			name: "straight off to the right",
+			profiles: [][]int{
+				testProfile([2]int{146, 154}), testProfile([2]int{146, 154}),
+				testProfile([2]int{146, 154}), testProfile([2]int{146, 154}),
+			},
+			visible: 4,
+			offset:  0.5,
+			ahead:   0.5,
+			centers: []int{150, 150, 150, 150},
+		},
+		{
+			name: "leaning right",
+			profiles: [][]int{
+				testProfile([2]int{96, 104}), testProfile([2]int{106, 114}),
+				testProfile([2]int{116, 124}), testProfile([2]int{126, 134}),
+			},
+			visible: 4,
+			offset:  -0.05,
+			heading: math.Pi / 4,
+			ahead:   0.25,
+			centers: []int{100, 110, 120, 130},
+		},
+		{
+			name: "follows the stretch nearest the band below",
+			profiles: [][]int{
+				centered, testProfile([2]int{20, 22}, [2]int{106, 114}),
+				testProfile([2]int{116, 124}), testProfile([2]int{126, 134}),
+			},
+			visible: 4,
+			offset:  -0.05,
+			heading: math.Pi / 4,
+			ahead:   0.25,
+			centers: []int{100, 110, 120, 130},
+		},
+		{
+			name:     "ends ahead",
+			profiles: [][]int{centered, centered, testProfile(), testProfile()},
+			visible:  2,
+			end:      true,
+			centers:  []int{100, 100},
+		},
+		{
+			name: "runs off the side of the frame",
+			profiles: [][]int{
+				centered, testProfile([2]int{0, 8}), testProfile(), testProfile(),
+			},
+			visible: 2,
+			offset:  0.48,
+			heading: math.Atan(-9.6),
+			ahead:   -1,
+			centers: []int{100, 4},
+		},
+		{
+			name: "crossing line",
+			profiles: [][]int{
+				centered, testProfile([2]int{40, 160}), centered, centered,
+			},
+			visible:      4,
+			intersection: true,
+			centers:      []int{100, 100, 100, 100},
+		},
+		{
+			name: "branch",
+			profiles: [][]int{
+				centered, centered, testProfile([2]int{60, 68}, [2]int{96, 104}), centered,
+			},
+			visible:      4,
+			intersection: true,
+			centers:      []int{100, 100, 100, 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rects := testBandRects(len(tt.profiles))
+			line := traceLine(rects, tt.profiles, testFrameWidth, testFrameHeight, DefaultLineFollowConfig())
+
+			if line.Visible != tt.visible || line.Intersection != tt.intersection || line.End != tt.end {
+				t.Fatalf("visible %d, intersection %v, end %v, want %d, %v, %v",
+					line.Visible, line.Intersection, line.End, tt.visible, tt.intersection, tt.end)
+			}
+			if !approxEqual(line.Offset, tt.offset) || !approxEqual(line.Heading, tt.heading) || !approxEqual(line.Ahead, tt.ahead) {
+				t.Errorf("offset %v, heading %v, ahead %v, want %v, %v, %v",
+					line.Offset, line.Heading, line.Ahead, tt.offset, tt.heading, tt.ahead)
+			}
+
+			var centers []int
+			for _, band := range line.Bands {
+				if band.Found {
+					centers = append(centers, band.Center.X)
+				}
+			}
+			if len(centers) != len(tt.centers) {
+				t.Fatalf("band centers %v, want %v", centers, tt.centers)
+			}
+			for i := range centers {
+				if centers[i] != tt.centers[i] {
+					t.Errorf("band centers %v, want %v", centers, tt.centers)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestFitPolynomial(t *testing.T) {
+	tests := []struct {
+		name   string
+		xs, ys []float64
+		degree int
+		want   []float64
+	}{
+		{"no points", nil, nil, 2, nil},
+		{"one point", []float64{1}, []float64{3}, 2, []float64{3}},
+		{"line through two points", []float64{0, 2}, []float64{1, 5}, 1, []float64{1, 2}},
+		{"exact quadratic", []float64{-1, 0, 1, 2}, []float64{6, 1, 0, 3}, 2, []float64{1, -3, 2}},
+		{"least squares line", []float64{0, 1, 2}, []float64{0, 2, 1}, 1, []float64{0.5, 0.5}},
+		{"same x falls back to the mean", []float64{1, 1}, []float64{0, 2}, 1, []float64{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitPolynomial(tt.xs, tt.ys, tt.degree)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !approxEqual(got[i], tt.want[i]) {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Melody notation defaults
+const (
+	DefaultTempo      = 120 // Beats (quarter notes) per minute
+	DefaultNoteLength = 4   // Quarter note
+	MinTempo          = 15  // Slower tempos overflow the 255 tick note duration
+	MaxTempo          = 960 // Faster tempos round short notes to nothing
+)
+
+// songGap is added after each chunk so the Roomba has finished playing before the next Play
+const songGap = 20 * time.Millisecond
+
+// noteOffsets maps note letters to semitones above C
+var noteOffsets = map[byte]int{
+	'C': 0, 'D': 2, 'E': 4, 'F': 5, 'G': 7, 'A': 9, 'B': 11,
+}
+
+// ParseMelody parses a melody written as space separated notes, e.g. "C4:8 E4:8 G4:4".
+//
+// Each note is a letter A-G, an optional # (sharp) or b (flat) and an octave, where C4 is
+// middle C. R is a rest. The optional length after the colon is the note value: 1 whole,
+// 2 half, 4 quarter (the default), 8 eighth and so on, with a trailing dot for a dotted
+// note. A token like T140 changes the tempo in beats per minute for the notes after it.
+func ParseMelody(text string) ([]Note, error) {
+	tempo := DefaultTempo
+	var notes []Note
+
+	for i, token := range strings.Fields(text) {
+		if token[0] == 'T' || token[0] == 't' {
+			bpm, err := strconv.Atoi(token[1:])
+			if err != nil || bpm < MinTempo || bpm > MaxTempo {
+				return nil, fmt.Errorf("token %d %q: tempo must be %d-%d", i+1, token, MinTempo, MaxTempo)
+			}
+			tempo = bpm
+			continue
+		}
+
+		note, err := parseNote(token, tempo)
+		if err != nil {
+			return nil, fmt.Errorf("token %d %q: %v", i+1, token, err)
+		}
+		notes = append(notes, note)
+	}
+
+	if len(notes) == 0 {
+		return nil, errors.New("melody has no notes")
+	}
+	return notes, nil
+}
+
+// parseNote parses a single note or rest with an optional length
+func parseNote(token string, tempo int) (Note, error) {
+	pitch, length, hasLength := strings.Cut(token, ":")
+
+	number, err := parsePitch(pitch)
+	if err != nil {
+		return Note{}, err
+	}
+
+	value := DefaultNoteLength
+	dotted := false
+	if hasLength {
+		if strings.HasSuffix(length, ".") {
+			dotted = true
+			length = strings.TrimSuffix(length, ".")
+		}
+		value, err = strconv.Atoi(length)
+		if err != nil || value <= 0 {
+			return Note{}, fmt.Errorf("invalid note length %q", length)
+		}
+	}
+
+	// A quarter note lasts one beat
+	seconds := 60 / float64(tempo) * 4 / float64(value)
+	if dotted {
+		seconds *= 1.5
+	}
+	ticks := math.Round(seconds * NoteTicksPerSecond)
+	if ticks < 1 || ticks > 255 {
+		return Note{}, fmt.Errorf("note lasts %.0f ticks, must be 1-255 at tempo %d", ticks, tempo)
+	}
+
+	return Note{Number: number, Duration: byte(ticks)}, nil
+}
+
+// parsePitch converts a note name like C#4 or Bb3 to a MIDI note number
+func parsePitch(pitch string) (byte, error) {
+	if pitch == "R" || pitch == "r" {
+		return RestNoteNumber, nil
+	}
+	if pitch == "" {
+		return 0, errors.New("missing note name")
+	}
+
+	offset, ok := noteOffsets[strings.ToUpper(pitch[:1])[0]]
+	if !ok {
+		return 0, fmt.Errorf("unknown note name %q", pitch[:1])
+	}
+	rest := pitch[1:]
+	if strings.HasPrefix(rest, "#") {
+		offset++
+		rest = rest[1:]
+	} else if strings.HasPrefix(rest, "b") {
+		offset--
+		rest = rest[1:]
+	}
+
+	octave, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid octave %q", rest)
+	}
+
+	// MIDI numbering puts C4 at 60
+	number := 12*(octave+1) + offset
+	if number < int(MinNoteNumber) || number > int(MaxNoteNumber) {
+		return 0, fmt.Errorf("note %s is outside the playable range G1-G9", pitch)
+	}
+	return byte(number), nil
+}
+
+// SongDuration returns how long a list of notes takes to play
+func SongDuration(notes []Note) time.Duration {
+	ticks := 0
+	for _, note := range notes {
+		ticks += int(note.Duration)
+	}
+	return time.Duration(ticks) * time.Second / NoteTicksPerSecond
+}
+
+// StoredMelody records the song slots a melody was split across by DefineMelody
+type StoredMelody struct {
+	Slots     []byte          // Song slots in playing order
+	Durations []time.Duration // How long each slot plays
+}
+
+// Duration returns how long the whole melody takes to play
+func (sm StoredMelody) Duration() time.Duration {
+	var total time.Duration
+	for _, d := range sm.Durations {
+		total += d
+	}
+	return total
+}
+
+// DefineMelody stores a melody of any length in consecutive song slots starting at firstSlot,
+// splitting it into songs of at most 16 notes
+func (r *Roomba) DefineMelody(firstSlot byte, notes []Note) (StoredMelody, error) {
+	if len(notes) == 0 {
+		return StoredMelody{}, errors.New("melody has no notes")
+	}
+
+	chunks := (len(notes) + MaxSongNotes - 1) / MaxSongNotes
+	if int(firstSlot)+chunks-1 > int(MaxSongSlot) {
+		return StoredMelody{}, fmt.Errorf("melody of %d notes needs %d song slots, only %d left from slot %d",
+			len(notes), chunks, int(MaxSongSlot)-int(firstSlot)+1, firstSlot)
+	}
+
+	var melody StoredMelody
+	for i := 0; i < chunks; i++ {
+		end := min((i+1)*MaxSongNotes, len(notes))
+		chunk := notes[i*MaxSongNotes : end]
+		slot := firstSlot + byte(i)
+
+		if err := r.DefineSong(slot, chunk); err != nil {
+			return StoredMelody{}, fmt.Errorf("failed to define song slot %d: %v", slot, err)
+		}
+		melody.Slots = append(melody.Slots, slot)
+		melody.Durations = append(melody.Durations, SongDuration(chunk))
+	}
+	return melody, nil
+}
+
+// PlayMelody plays the slots of a melody back to back, returning once it has finished.
+// The Roomba ignores Play while a song is playing, so each slot waits for the previous one.
+func (r *Roomba) PlayMelody(ctx context.Context, melody StoredMelody) error {
+	for i, slot := range melody.Slots {
+		if err := r.PlaySong(slot); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(melody.Durations[i] + songGap):
+		}
+	}
+	return nil
+}
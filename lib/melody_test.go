@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMelody(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Note
+	}{
+		{"default quarter notes", "C4 E4 G4", []Note{{60, 32}, {64, 32}, {67, 32}}},
+		{"note lengths", "C4:1 C4:2 C4:8 C4:16", []Note{{60, 128}, {60, 64}, {60, 16}, {60, 8}}},
+		{"dotted note", "C4:4.", []Note{{60, 48}}},
+		{"sharps and flats", "C#4 Bb3 f#5", []Note{{61, 32}, {58, 32}, {78, 32}}},
+		{"rest", "R:8 r", []Note{{RestNoteNumber, 16}, {RestNoteNumber, 32}}},
+		{"tempo change", "C4 T60 C4 t240 C4", []Note{{60, 32}, {60, 64}, {60, 16}}},
+		{"range limits", "G1 G9", []Note{{31, 32}, {127, 32}}},
+		{"extra spaces", "  C4 \t E4\n", []Note{{60, 32}, {64, 32}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMelody(tt.text)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMelodyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string // Part of the error message
+	}{
+		{"empty", "", "no notes"},
+		{"only a tempo", "T120", "no notes"},
+		{"unknown note", "H4", "unknown note name"},
+		{"missing octave", "C", "invalid octave"},
+		{"below range", "F#1", "outside the playable range"},
+		{"above range", "A9", "outside the playable range"},
+		{"bad length", "C4:0", "invalid note length"},
+		{"length not a number", "C4:x", "invalid note length"},
+		{"missing note name", ":4", "missing note name"},
+		{"tempo too slow", "T14 C4", "tempo must be"},
+		{"tempo too fast", "T961 C4", "tempo must be"},
+		{"note too long", "T15 C4:1", "ticks"},
+		{"note too short", "T960 C4:64", "ticks"},
+		{"names the bad token", "C4 E4 X4", `token 3 "X4"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes, err := ParseMelody(tt.text)
+			if err == nil {
+				t.Fatalf("got %v, want an error", notes)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSongDuration(t *testing.T) {
+	notes, err := ParseMelody("C4 E4 G4 C5:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := SongDuration(notes).Seconds(), 2.5; got != want {
+		t.Errorf("got %vs, want %vs", got, want)
+	}
+}
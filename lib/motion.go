@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Tuning for the closed-loop motion primitives
+const (
+	motionBufferSize        = 32              // Readings a primitive can fall behind without losing motion
+	approachDistance        = 100.0           // mm before the target where driving slows down
+	approachAngle           = 15.0            // degrees before the target where rotating slows down
+	approachSpeed     int16 = 60              // mm/s used for the final approach
+	motionTimeoutPad        = 2 * time.Second // Added to the expected duration before giving up
+	motionTimeoutMult       = 2               // Multiple of the expected duration before giving up
+)
+
+var (
+	// ErrNoSensorFeedback is returned when a closed-loop command is used without a running sensor poller
+	ErrNoSensorFeedback = errors.New("sensor polling is not running")
+	// ErrMotionTimeout is returned when a closed-loop command does not reach its target in time
+	ErrMotionTimeout = errors.New("motion did not reach its target in time")
+)
+
+// DriveDistance drives straight for the given distance in mm (negative reverses) at speed mm/s,
+// stopping when the distance sensor reports the target was reached.
+// It gives up after twice the expected time or when ctx is done, stopping the robot either way.
+func (r *Roomba) DriveDistance(ctx context.Context, mm int, speed int16) error {
+	if mm == 0 {
+		return nil
+	}
+	if speed <= 0 {
+		return fmt.Errorf("speed must be positive, got %d", speed)
+	}
+
+	target := math.Abs(float64(mm))
+	direction := int16(1)
+	if mm < 0 {
+		direction = -1
+	}
+
+	return r.runClosedLoop(ctx, target, speed, func(data SensorData) float64 {
+		return float64(data.Distance) * float64(direction)
+	}, func(s int16) error {
+		return r.Drive(direction*s, StraightRadius)
+	}, approachDistance)
+}
+
+// RotateBy turns in place by the given angle in degrees (positive is counter-clockwise)
+// at the given wheel speed in mm/s, stopping when the angle sensor reports the target was reached.
+// It gives up after twice the expected time or when ctx is done, stopping the robot either way.
+func (r *Roomba) RotateBy(ctx context.Context, degrees float64, speed int16) error {
+	if degrees == 0 {
+		return nil
+	}
+	if speed <= 0 {
+		return fmt.Errorf("speed must be positive, got %d", speed)
+	}
+
+	direction := 1.0
+	if degrees < 0 {
+		direction = -1
+	}
+
+	// Convert the angle to wheel travel so the timeout uses the same units as speed
+	wheelTravel := math.Abs(degrees) * math.Pi / 180 * WheelBase / 2
+	degreesPerMM := math.Abs(degrees) / wheelTravel
+
+	return r.runClosedLoop(ctx, wheelTravel, speed, func(data SensorData) float64 {
+		return data.AngleIn(r.AngleUnits) * direction / degreesPerMM
+	}, func(s int16) error {
+		return r.Spin(int16(direction) * s)
+	}, approachAngle/degreesPerMM)
+}
+
+// runClosedLoop moves with the given command until progress reaches target, slowing down
+// for the last approach stretch. progress extracts the distance covered by one reading.
+func (r *Roomba) runClosedLoop(ctx context.Context, target float64, speed int16, progress func(SensorData) float64, move func(int16) error, approach float64) error {
+	// Only packet groups 0 and 2 carry distance and angle
+	poller := r.Poller()
+	if poller == nil || (poller.PacketID() != SensorPacketAll && poller.PacketID() != SensorPacketControls) {
+		return ErrNoSensorFeedback
+	}
+
+	readings := poller.SubscribeBuffered(motionBufferSize)
+	defer poller.Unsubscribe(readings)
+
+	// Allow for acceleration and slow final approach
+	expected := time.Duration(target / float64(speed) * float64(time.Second))
+	ctx, cancel := context.WithTimeout(ctx, expected*motionTimeoutMult+motionTimeoutPad)
+	defer cancel()
+
+	if err := move(speed); err != nil {
+		return err
+	}
+
+	covered := 0.0
+	slowed := false
+	for {
+		select {
+		case <-ctx.Done():
+			r.Stop()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w: covered %.0f of %.0f", ErrMotionTimeout, covered, target)
+			}
+			return ctx.Err()
+
+		case data, ok := <-readings:
+			if !ok {
+				r.Stop()
+				return ErrNoSensorFeedback
+			}
+
+			// Each reading shows the loop is still in control, so keep the lease alive
+			r.Heartbeat()
+
+			covered += progress(data)
+			remaining := target - covered
+			if remaining <= 0 {
+				return r.Stop()
+			}
+
+			// Slow down near the target so the stop lands close to it
+			if !slowed && remaining < approach && speed > approachSpeed {
+				slowed = true
+				if err := move(approachSpeed); err != nil {
+					r.Stop()
+					return err
+				}
+			}
+		}
+	}
+}
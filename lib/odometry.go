@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// odometryBufferSize is how many readings odometry can fall behind without losing motion
+const odometryBufferSize = 32
+
+// AngleUnits selects how the angle sensor reading is interpreted
+type AngleUnits int
+
+const (
+	AngleUnitsSCI     AngleUnits = iota // SCI Roombas: half the wheel distance difference in mm
+	AngleUnitsDegrees                   // Open Interface Roombas: degrees
+)
+
+// AngleIn returns the angle reading in degrees, interpreting the raw value with the given units
+func (sd SensorData) AngleIn(units AngleUnits) float64 {
+	if units == AngleUnitsDegrees {
+		return float64(sd.Angle)
+	}
+	return sd.AngleDegrees()
+}
+
+// Pose is a 2D position and heading relative to where odometry was last reset
+type Pose struct {
+	X         float64   // mm, forward from the reset position
+	Y         float64   // mm, left of the reset position
+	Heading   float64   // radians, counter-clockwise is positive
+	Timestamp time.Time // When the pose was computed
+}
+
+// HeadingDegrees returns the heading in degrees
+func (p Pose) HeadingDegrees() float64 {
+	return p.Heading * 180 / math.Pi
+}
+
+// DistanceTo returns the straight line distance to another pose in mm
+func (p Pose) DistanceTo(other Pose) float64 {
+	return math.Hypot(other.X-p.X, other.Y-p.Y)
+}
+
+// OdometryConfig holds configuration for pose integration
+type OdometryConfig struct {
+	AngleUnits  AngleUnits // How the robot reports its angle
+	PathSpacing float64    // Minimum distance in mm between recorded path points
+	MaxPathSize int        // Maximum number of path points kept, oldest are dropped
+}
+
+// DefaultOdometryConfig returns reasonable default settings
+func DefaultOdometryConfig() OdometryConfig {
+	return OdometryConfig{
+		AngleUnits:  AngleUnitsSCI,
+		PathSpacing: 20,   // Record a point every 2 cm
+		MaxPathSize: 5000, // About 100 m of path
+	}
+}
+
+// Odometry integrates distance and angle readings into a pose
+type Odometry struct {
+	config   OdometryConfig
+	pose     Pose
+	path     []Pose
+	traveled float64 // Total distance driven in mm, regardless of direction
+	mu       sync.RWMutex
+	poller   *SensorPoller
+	readings <-chan SensorData
+	running  bool
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewOdometry creates odometry starting at the origin
+func NewOdometry(config OdometryConfig) *Odometry {
+	o := &Odometry{config: config}
+	o.Reset()
+	return o
+}
+
+// Start integrates every reading from the poller until Stop is called
+func (o *Odometry) Start(poller *SensorPoller) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.running {
+		return
+	}
+	o.running = true
+	o.poller = poller
+	o.readings = poller.SubscribeBuffered(odometryBufferSize)
+	o.stopChan = make(chan struct{})
+	o.doneChan = make(chan struct{})
+
+	go o.updateLoop(o.readings, o.stopChan, o.doneChan)
+}
+
+// Stop stops integrating readings
+func (o *Odometry) Stop() {
+	o.mu.Lock()
+	if !o.running {
+		o.mu.Unlock()
+		return
+	}
+	o.running = false
+	close(o.stopChan)
+	done := o.doneChan
+	o.poller.Unsubscribe(o.readings)
+	o.mu.Unlock()
+
+	<-done
+}
+
+// Reset moves the origin to the current position and clears the path
+func (o *Odometry) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pose = Pose{Timestamp: time.Now()}
+	o.path = []Pose{o.pose}
+	o.traveled = 0
+}
+
+// Pose returns the current pose
+func (o *Odometry) Pose() Pose {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.pose
+}
+
+// Path returns a copy of the recorded path, oldest first
+func (o *Odometry) Path() []Pose {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return append([]Pose(nil), o.path...)
+}
+
+// Traveled returns the total distance driven since the last reset in mm
+func (o *Odometry) Traveled() float64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.traveled
+}
+
+// Update integrates a single sensor reading.
+// Readings without distance and angle (packets 1 and 3) are ignored.
+func (o *Odometry) Update(data SensorData) {
+	if data.PacketID != SensorPacketAll && data.PacketID != SensorPacketControls {
+		return
+	}
+
+	distance := float64(data.Distance)
+	turn := data.AngleIn(o.config.AngleUnits) * math.Pi / 180
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Move along the average heading over the interval
+	midHeading := o.pose.Heading + turn/2
+	o.pose.X += distance * math.Cos(midHeading)
+	o.pose.Y += distance * math.Sin(midHeading)
+	o.pose.Heading = normalizeAngle(o.pose.Heading + turn)
+	o.pose.Timestamp = data.Timestamp
+	o.traveled += math.Abs(distance)
+
+	// Record the path at a fixed spacing so it doesn't grow while standing still
+	if o.pose.DistanceTo(o.path[len(o.path)-1]) >= o.config.PathSpacing {
+		o.path = append(o.path, o.pose)
+		if o.config.MaxPathSize > 0 && len(o.path) > o.config.MaxPathSize {
+			o.path = o.path[len(o.path)-o.config.MaxPathSize:]
+		}
+	}
+}
+
+// updateLoop feeds readings from the poller into Update
+func (o *Odometry) updateLoop(readings <-chan SensorData, stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case data, ok := <-readings:
+			if !ok {
+				return
+			}
+			o.Update(data)
+		}
+	}
+}
+
+// normalizeAngle wraps an angle in radians to -pi..pi
+func normalizeAngle(angle float64) float64 {
+	return math.Remainder(angle, 2*math.Pi)
+}
@@ -0,0 +1,317 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SensorPacketOIMode is the Open Interface sensor packet holding the current mode (1 byte).
+// SCI Roombas do not support it and leave the query unanswered.
+const SensorPacketOIMode byte = 35
+
+// DefaultModePollInterval is how often the mode monitor reads back the OI mode by default
+const DefaultModePollInterval = 500 * time.Millisecond
+
+// modeQueryMaxTimeouts is how many unanswered mode queries in a row make the monitor
+// give up, so an SCI Roomba does not stall the command queue forever
+const modeQueryMaxTimeouts = 3
+
+// modeQueryTimeout is how long to wait for the one byte mode reply. It is kept short because the
+// query holds the command queue while it waits, and an SCI Roomba never answers it.
+const modeQueryTimeout = 50 * time.Millisecond
+
+// OIMode is the operating mode of the Roomba's interface
+type OIMode byte
+
+const (
+	OIModeOff     OIMode = 0 // Interface not started
+	OIModePassive OIMode = 1 // Sensors only, the robot ignores actuator commands
+	OIModeSafe    OIMode = 2 // Full control, but cliffs, wheel drops and charging fall back to passive
+	OIModeFull    OIMode = 3 // Full control with no safety features
+)
+
+// String returns the mode name
+func (m OIMode) String() string {
+	switch m {
+	case OIModeOff:
+		return "off"
+	case OIModePassive:
+		return "passive"
+	case OIModeSafe:
+		return "safe"
+	case OIModeFull:
+		return "full"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(m))
+	}
+}
+
+// ParseOIMode parses a mode name, accepting only the modes a driver can request
+func ParseOIMode(name string) (OIMode, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "safe":
+		return OIModeSafe, nil
+	case "full":
+		return OIModeFull, nil
+	default:
+		return OIModeOff, fmt.Errorf("unknown mode %q, expected safe or full", name)
+	}
+}
+
+// Mode returns the last known OI mode, from the last mode command or QueryOIMode
+func (r *Roomba) Mode() OIMode {
+	r.modeMu.RLock()
+	defer r.modeMu.RUnlock()
+	return r.mode
+}
+
+// RequestedMode returns the mode most recently commanded
+func (r *Roomba) RequestedMode() OIMode {
+	r.modeMu.RLock()
+	defer r.modeMu.RUnlock()
+	return r.requestedMode
+}
+
+// SetMode enters safe or full mode
+func (r *Roomba) SetMode(mode OIMode) error {
+	switch mode {
+	case OIModeSafe:
+		return r.SafeMode()
+	case OIModeFull:
+		return r.FullMode()
+	default:
+		return fmt.Errorf("cannot enter %s mode directly", mode)
+	}
+}
+
+// QueryOIMode reads the current mode back from the Roomba (OI only) and updates Mode
+func (r *Roomba) QueryOIMode() (OIMode, error) {
+	reply, err := r.submit(&command{
+		frame:    []byte{r.Cmds.CmdSensors, SensorPacketOIMode},
+		replyLen: 1,
+		timeout:  modeQueryTimeout,
+	})
+	if err != nil {
+		return OIModeOff, fmt.Errorf("failed to read OI mode: %w", err)
+	}
+
+	mode := OIMode(reply[0])
+	r.modeMu.Lock()
+	r.mode = mode
+	r.modeMu.Unlock()
+	return mode, nil
+}
+
+// sendModeCommand sends a mode changing command and records the mode it selects
+func (r *Roomba) sendModeCommand(cmd byte, mode OIMode) error {
+	if err := r.sendCommand(cmd); err != nil {
+		return err
+	}
+	r.recordMode(mode)
+	return nil
+}
+
+// sendDrivingModeCommand sends a cleaning or docking command and records the mode it selects
+func (r *Roomba) sendDrivingModeCommand(cmd byte, mode OIMode) error {
+	if err := r.sendDrivingCommand(cmd); err != nil {
+		return err
+	}
+	r.recordMode(mode)
+	return nil
+}
+
+// recordMode remembers a mode the driver put the Roomba in
+func (r *Roomba) recordMode(mode OIMode) {
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+	r.mode = mode
+	r.requestedMode = mode
+}
+
+// ModeFallback describes the Roomba leaving the requested mode on its own
+type ModeFallback struct {
+	Requested OIMode    // Mode the driver asked for
+	Actual    OIMode    // Mode the Roomba reported instead
+	Time      time.Time // When the change was noticed
+}
+
+// String returns a human readable description of the fallback
+func (mf ModeFallback) String() string {
+	return fmt.Sprintf("dropped from %s to %s mode", mf.Requested, mf.Actual)
+}
+
+// ModeMonitor periodically reads back the OI mode and reports when the Roomba drops
+// out of safe or full mode, e.g. to passive after a cliff in safe mode.
+// The requested mode is only re-entered when Restore is called.
+type ModeMonitor struct {
+	roomba     *Roomba
+	interval   time.Duration
+	fallback   *ModeFallback
+	lastErr    error
+	failures   failureLog
+	timeouts   int
+	onFallback []func(ModeFallback)
+	running    bool
+	mu         sync.Mutex
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+// NewModeMonitor creates a monitor that checks the mode at the given interval
+func NewModeMonitor(roomba *Roomba, interval time.Duration) *ModeMonitor {
+	if interval <= 0 {
+		interval = DefaultModePollInterval
+	}
+
+	return &ModeMonitor{
+		roomba:   roomba,
+		interval: interval,
+		failures: failureLog{prefix: "Error checking OI mode"},
+	}
+}
+
+// OnFallback registers a callback run once each time the Roomba leaves the requested mode
+func (mm *ModeMonitor) OnFallback(callback func(ModeFallback)) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.onFallback = append(mm.onFallback, callback)
+}
+
+// Start begins checking the mode in a separate goroutine
+func (mm *ModeMonitor) Start() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	if mm.running {
+		return
+	}
+	mm.running = true
+	mm.stopChan = make(chan struct{})
+	mm.doneChan = make(chan struct{})
+
+	go mm.monitorLoop(mm.stopChan, mm.doneChan)
+}
+
+// Stop stops checking the mode
+func (mm *ModeMonitor) Stop() {
+	mm.mu.Lock()
+	if !mm.running {
+		mm.mu.Unlock()
+		return
+	}
+	mm.running = false
+	close(mm.stopChan)
+	done := mm.doneChan
+	mm.mu.Unlock()
+
+	<-done
+}
+
+// Fallback returns the pending fallback, if the Roomba has left the requested mode
+func (mm *ModeMonitor) Fallback() (ModeFallback, bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	if mm.fallback == nil {
+		return ModeFallback{}, false
+	}
+	return *mm.fallback, true
+}
+
+// LastError returns the error from the most recent mode query, or nil if it succeeded
+func (mm *ModeMonitor) LastError() error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.lastErr
+}
+
+// Restore re-enters the requested mode after a fallback, once the operator has confirmed it is safe
+func (mm *ModeMonitor) Restore() error {
+	mm.mu.Lock()
+	fallback := mm.fallback
+	mm.mu.Unlock()
+
+	if fallback == nil {
+		return nil
+	}
+
+	if err := mm.roomba.SetMode(fallback.Requested); err != nil {
+		return fmt.Errorf("failed to re-enter %s mode: %v", fallback.Requested, err)
+	}
+
+	mm.mu.Lock()
+	mm.fallback = nil
+	mm.mu.Unlock()
+
+	log.Printf("Re-entered %s mode", fallback.Requested)
+	return nil
+}
+
+// monitorLoop queries the mode at the configured interval until stopped
+func (mm *ModeMonitor) monitorLoop(stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	ticker := time.NewTicker(mm.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			if !mm.check() {
+				log.Printf("OI mode packet not supported, mode monitoring disabled")
+				return
+			}
+		}
+	}
+}
+
+// check reads the mode once and records a fallback if the Roomba left the requested mode.
+// It returns false once the Roomba has repeatedly failed to answer.
+func (mm *ModeMonitor) check() bool {
+	requested := mm.roomba.RequestedMode()
+	actual, err := mm.roomba.QueryOIMode()
+
+	mm.mu.Lock()
+	if err != nil {
+		mm.failures.fail(err)
+		mm.lastErr = err
+		if errors.Is(err, ErrSensorTimeout) {
+			mm.timeouts++
+		}
+		supported := mm.timeouts < modeQueryMaxTimeouts
+		mm.mu.Unlock()
+		return supported
+	}
+	mm.failures.ok()
+	mm.lastErr = nil
+	mm.timeouts = 0
+
+	// Only safe and full mode can be left involuntarily
+	if actual == requested || (requested != OIModeSafe && requested != OIModeFull) {
+		// Back in the requested mode, e.g. after a mode command from elsewhere
+		mm.fallback = nil
+		mm.mu.Unlock()
+		return true
+	}
+	if mm.fallback != nil {
+		mm.mu.Unlock()
+		return true
+	}
+
+	fallback := ModeFallback{Requested: requested, Actual: actual, Time: time.Now()}
+	mm.fallback = &fallback
+	callbacks := append(([]func(ModeFallback))(nil), mm.onFallback...)
+	mm.mu.Unlock()
+
+	log.Printf("Roomba %s", fallback)
+	for _, callback := range callbacks {
+		callback(fallback)
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"math"
+	"time"
+)
+
+// PIDConfig holds the gains and limits of a PID controller
+type PIDConfig struct {
+	Kp            float64 `json:"kp"`             // Proportional gain
+	Ki            float64 `json:"ki"`             // Integral gain, per second
+	Kd            float64 `json:"kd"`             // Derivative gain, in seconds
+	IntegralLimit float64 `json:"integral_limit"` // Largest accumulated error the integral may hold, in error-seconds, 0 leaves it unclamped
+	OutputLimit   float64 `json:"output_limit"`   // Output is clamped to ±OutputLimit, 0 leaves it unclamped
+}
+
+// PIDController turns an error signal into a correction.
+// The integral is clamped to IntegralLimit and stops growing while the output is saturated,
+// so a long stretch off target doesn't leave it overshooting once it gets back.
+type PIDController struct {
+	config    PIDConfig
+	integral  float64
+	lastError float64
+	lastTime  time.Time
+	primed    bool // Whether lastError and lastTime hold a previous update
+}
+
+// NewPIDController creates a controller with the given gains and limits
+func NewPIDController(config PIDConfig) *PIDController {
+	return &PIDController{config: config}
+}
+
+// Update takes the error measured at now and returns the clamped output
+func (pc *PIDController) Update(err float64, now time.Time) float64 {
+	dt := 0.0
+	if pc.primed {
+		dt = now.Sub(pc.lastTime).Seconds()
+	}
+
+	derivative := 0.0
+	if dt > 0 {
+		derivative = (err - pc.lastError) / dt
+	}
+
+	// Integrate tentatively, keeping the new integral only if it doesn't push a saturated output further
+	integral := pc.integral
+	if dt > 0 {
+		integral = clampAbs(integral+err*dt, pc.config.IntegralLimit)
+	}
+	output := pc.config.Kp*err + pc.config.Ki*integral + pc.config.Kd*derivative
+	limited := clampAbs(output, pc.config.OutputLimit)
+	if limited == output || math.Abs(integral) < math.Abs(pc.integral) {
+		pc.integral = integral
+	}
+
+	pc.lastError = err
+	pc.lastTime = now
+	pc.primed = true
+	return limited
+}
+
+// Reset forgets the integral and the previous error, e.g. after the target was lost
+func (pc *PIDController) Reset() {
+	pc.integral = 0
+	pc.lastError = 0
+	pc.lastTime = time.Time{}
+	pc.primed = false
+}
+
+// clampAbs limits value to ±limit, a limit of 0 or less leaves it unchanged
+func clampAbs(value, limit float64) float64 {
+	if limit <= 0 {
+		return value
+	}
+	return math.Max(-limit, math.Min(limit, value))
+}
@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// probeWakeDelay is a shorter wake delay used while probing ports, an awake Roomba answers right away
+const probeWakeDelay = 500 * time.Millisecond
+
+// ErrPortNotFound is returned when no serial port matches or answers like a Roomba
+var ErrPortNotFound = errors.New("roomba serial port not found")
+
+// PortInfo describes a serial port found on the system
+type PortInfo struct {
+	Name         string // Device path, e.g. /dev/ttyUSB0
+	IsUSB        bool   // Whether the port belongs to a USB adapter
+	VID          string // USB vendor ID in hex, e.g. 0403
+	PID          string // USB product ID in hex, e.g. 6015
+	SerialNumber string // USB serial number, if the adapter has one
+	Product      string // Product description, availability depends on the OS
+}
+
+// String returns a one line description of the port
+func (pi PortInfo) String() string {
+	if !pi.IsUSB {
+		return pi.Name
+	}
+
+	desc := fmt.Sprintf("%s  USB %s:%s", pi.Name, pi.VID, pi.PID)
+	if pi.SerialNumber != "" {
+		desc += "  serial " + pi.SerialNumber
+	}
+	if pi.Product != "" {
+		desc += "  " + pi.Product
+	}
+	return desc
+}
+
+// USBMatch selects a USB serial adapter by its identifiers. Empty fields match anything.
+type USBMatch struct {
+	VID          string // USB vendor ID in hex, case insensitive
+	PID          string // USB product ID in hex, case insensitive
+	SerialNumber string // Tells identical adapters apart
+}
+
+// IsZero reports whether no identifier is set
+func (m USBMatch) IsZero() bool {
+	return m.VID == "" && m.PID == "" && m.SerialNumber == ""
+}
+
+// Matches reports whether a port belongs to the selected adapter
+func (m USBMatch) Matches(port PortInfo) bool {
+	if !port.IsUSB || m.IsZero() {
+		return false
+	}
+	return (m.VID == "" || strings.EqualFold(m.VID, port.VID)) &&
+		(m.PID == "" || strings.EqualFold(m.PID, port.PID)) &&
+		(m.SerialNumber == "" || m.SerialNumber == port.SerialNumber)
+}
+
+// String returns the identifiers in VID:PID form
+func (m USBMatch) String() string {
+	desc := fmt.Sprintf("%s:%s", orAny(m.VID), orAny(m.PID))
+	if m.SerialNumber != "" {
+		desc += " serial " + m.SerialNumber
+	}
+	return desc
+}
+
+// orAny returns the value, or * if it is empty
+func orAny(value string) string {
+	if value == "" {
+		return "*"
+	}
+	return value
+}
+
+// ListPorts returns the serial ports on the system with their USB details, sorted by name
+func ListPorts() ([]PortInfo, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list serial ports: %v", err)
+	}
+
+	ports := make([]PortInfo, 0, len(details))
+	for _, d := range details {
+		ports = append(ports, PortInfo{
+			Name:         d.Name,
+			IsUSB:        d.IsUSB,
+			VID:          d.VID,
+			PID:          d.PID,
+			SerialNumber: d.SerialNumber,
+			Product:      d.Product,
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports, nil
+}
+
+// FindPort returns the port of the USB adapter selected by match.
+// It fails if no port or more than one port matches.
+func FindPort(match USBMatch) (string, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, port := range ports {
+		if match.Matches(port) {
+			found = append(found, port.Name)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: no USB adapter matches %s", ErrPortNotFound, match)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%d USB adapters match %s (%s), add a serial number to pick one",
+			len(found), match, strings.Join(found, ", "))
+	}
+}
+
+// ProbePorts opens each port in turn and returns the first one where a Roomba answers
+// Start and a sensor query at the given baud rate. USB ports are tried first.
+func ProbePorts(ports []PortInfo, baudRate int) (string, error) {
+	ordered := append([]PortInfo(nil), ports...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].IsUSB && !ordered[j].IsUSB })
+
+	for _, port := range ordered {
+		if err := probePort(port.Name, baudRate); err != nil {
+			log.Printf("No Roomba on %s: %v", port.Name, err)
+			continue
+		}
+		return port.Name, nil
+	}
+	return "", fmt.Errorf("%w: no Roomba answered on %d port(s)", ErrPortNotFound, len(ordered))
+}
+
+// DiscoverPort finds the Roomba's port: by USB identifiers when match is set,
+// otherwise, or if that fails, by probing every port
+func DiscoverPort(match USBMatch, baudRate int) (string, error) {
+	if !match.IsZero() {
+		name, err := FindPort(match)
+		if err == nil {
+			return name, nil
+		}
+		log.Printf("%v, probing all ports instead", err)
+	}
+
+	ports, err := ListPorts()
+	if err != nil {
+		return "", err
+	}
+	return ProbePorts(ports, baudRate)
+}
+
+// probePort checks whether a Roomba answers on the named port
+func probePort(name string, baudRate int) error {
+	r := NewRoomba(name, baudRate)
+	r.WakeDelay = probeWakeDelay
+	r.ReconnectDelay = 0
+	r.ProbeBaudRates = []int{baudRate}
+
+	err := r.Connect()
+	r.Close()
+	return err
+}
@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultReconnectDelay is how long to wait between attempts to reopen a lost port
+const DefaultReconnectDelay = time.Second
+
+// ConnectionState is the state of the link to the Roomba
+type ConnectionState int
+
+const (
+	ConnDisconnected ConnectionState = iota // Not connected, or lost with reconnecting disabled
+	ConnConnected                           // Commands are being sent
+	ConnReconnecting                        // The port failed and is being reopened
+)
+
+// String returns the state name
+func (cs ConnectionState) String() string {
+	switch cs {
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnConnected:
+		return "connected"
+	case ConnReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(cs))
+	}
+}
+
+// ConnectionState returns the state of the link to the Roomba
+func (r *Roomba) ConnectionState() ConnectionState {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.connState
+}
+
+// PortName returns the port in use, which changes if the adapter reappears under a new path
+func (r *Roomba) PortName() string {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.portName
+}
+
+// OnConnectionChange registers a callback run whenever the connection state changes
+func (r *Roomba) OnConnectionChange(callback func(ConnectionState)) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	r.onConnChange = append(r.onConnChange, callback)
+}
+
+// setConnectionState records the state and notifies callbacks if it changed
+func (r *Roomba) setConnectionState(state ConnectionState) {
+	r.connMu.Lock()
+	if r.connState == state {
+		r.connMu.Unlock()
+		return
+	}
+	r.connState = state
+	callbacks := append(([]func(ConnectionState))(nil), r.onConnChange...)
+	r.connMu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(state)
+	}
+}
+
+// isIOError reports whether a command failed because the port itself failed,
+// rather than the Roomba not answering in time
+func isIOError(err error) bool {
+	return err != nil && !errors.Is(err, ErrSensorTimeout)
+}
+
+// canReconnect reports whether a lost port can be reopened
+func (r *Roomba) canReconnect() bool {
+	return r.ReconnectDelay > 0 && r.PortName() != ""
+}
+
+// connectionLost is called by the writer after an I/O error. It returns true if the port
+// is being reopened in the background, in which case the writer must exit; commands fail
+// with ErrNotConnected meanwhile.
+func (r *Roomba) connectionLost(cause error) bool {
+	if !r.canReconnect() {
+		return false
+	}
+
+	r.connMu.Lock()
+	if r.reconnectStop != nil || r.connState != ConnConnected {
+		r.connMu.Unlock()
+		return false
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	r.reconnectStop, r.reconnectDone = stop, done
+	r.connMu.Unlock()
+
+	log.Printf("Lost connection to Roomba: %v", cause)
+	go r.reconnectLoop(stop, done)
+	return true
+}
+
+// stopReconnecting stops a reconnect in progress and waits for it to give up
+func (r *Roomba) stopReconnecting() {
+	r.connMu.Lock()
+	stop, done := r.reconnectStop, r.reconnectDone
+	r.connMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// reconnectLoop reopens the port until it succeeds or Close is called
+func (r *Roomba) reconnectLoop(stop, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		r.connMu.Lock()
+		r.reconnectStop, r.reconnectDone = nil, nil
+		r.connMu.Unlock()
+	}()
+
+	// Waits for the failed writer to exit, then fails everything still queued,
+	// so motion sent before the failure is never replayed
+	r.stopWriter()
+	r.cancelLease()
+
+	// Callbacks run here rather than on the writer, so they can send commands without waiting on it forever
+	r.setConnectionState(ConnReconnecting)
+
+	failures := failureLog{prefix: fmt.Sprintf("Reconnect failed, retrying every %v", r.ReconnectDelay)}
+	for attempt := 1; ; attempt++ {
+		err := r.reconnect()
+		if err == nil {
+			log.Printf("Reconnected to Roomba on %s after %d attempt(s)", r.PortName(), attempt)
+			r.setConnectionState(ConnConnected)
+			return
+		}
+		failures.fail(err)
+
+		select {
+		case <-stop:
+			r.setConnectionState(ConnDisconnected)
+			return
+		case <-time.After(r.ReconnectDelay):
+		}
+	}
+}
+
+// reconnect makes one attempt to reopen the port and restore the Roomba's mode
+func (r *Roomba) reconnect() error {
+	if r.port != nil {
+		r.port.Close()
+		r.port = nil
+	}
+
+	port, err := r.openLostPort()
+	if err != nil {
+		return err
+	}
+	r.port = port
+	if err := r.configurePort(); err != nil {
+		r.port.Close()
+		r.port = nil
+		return err
+	}
+	r.startWriter()
+
+	// Start drops the Roomba to passive, so remember the mode to go back to
+	mode := r.RequestedMode()
+	if err := r.Start(); err != nil {
+		r.stopWriter()
+		return err
+	}
+	if mode == OIModeSafe || mode == OIModeFull {
+		if err := r.SetMode(mode); err != nil {
+			r.stopWriter()
+			return err
+		}
+	}
+
+	// Whatever the robot was doing before the failure is stale now
+	if err := r.Stop(); err != nil {
+		r.stopWriter()
+		return err
+	}
+	return nil
+}
+
+// openLostPort reopens the port by name, or finds the same USB adapter under a new name
+func (r *Roomba) openLostPort() (Transport, error) {
+	name := r.PortName()
+	port, err := OpenTransport(name, r.BaudRate())
+	if err == nil {
+		return port, nil
+	}
+
+	r.connMu.Lock()
+	id := r.usbID
+	r.connMu.Unlock()
+	if id == nil {
+		return nil, err
+	}
+
+	moved, findErr := FindPort(*id)
+	if findErr != nil || moved == name {
+		return nil, err
+	}
+
+	port, err = OpenTransport(moved, r.BaudRate())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Roomba adapter moved from %s to %s", name, moved)
+
+	r.connMu.Lock()
+	r.portName = moved
+	r.connMu.Unlock()
+	return port, nil
+}
+
+// rememberUSBIdentity records the VID, PID and serial number of the adapter behind the port,
+// if it is a USB serial port
+func (r *Roomba) rememberUSBIdentity() {
+	name := r.PortName()
+	if name == "" || strings.HasPrefix(name, tcpPrefix) {
+		return
+	}
+
+	// Compare resolved paths so /dev/serial/by-id links match the device they point to
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		resolved = name
+	}
+
+	ports, err := ListPorts()
+	if err != nil {
+		return
+	}
+	for _, port := range ports {
+		if port.IsUSB && (port.Name == name || port.Name == resolved) {
+			r.connMu.Lock()
+			r.usbID = &USBMatch{VID: port.VID, PID: port.PID, SerialNumber: port.SerialNumber}
+			r.connMu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// RecordFormat is how a recording stores its frames
+type RecordFormat string
+
+const (
+	RecordPNG   RecordFormat = "png" // Lossless image sequence, replays exactly what the camera saw
+	RecordJPEG  RecordFormat = "jpg" // Smaller image sequence, slightly lossy
+	RecordVideo RecordFormat = "avi" // Motion JPEG video, smallest but lossy
+)
+
+// Files inside a recording directory
+const (
+	RecordLogFile    = "log.jsonl"  // One RecordEntry per line
+	RecordFramesDir  = "frames"     // Image sequence, one file per detection entry
+	RecordVideoFile  = "frames.avi" // Video, one frame per detection entry in order
+	recordQueueSize  = 64           // Frames waiting to be written before new ones are dropped
+	recordVideoFPS   = 30           // Nominal rate written into recorded videos
+	recordTimeLayout = "20060102-150405"
+)
+
+// Kinds of RecordEntry
+const (
+	RecordKindDetection = "detection" // A frame and what the detector found in it
+	RecordKindDrive     = "drive"     // A tracker decision and the commands it sent
+)
+
+// ParseRecordFormat returns the format with the given name
+func ParseRecordFormat(name string) (RecordFormat, error) {
+	switch format := RecordFormat(name); format {
+	case RecordPNG, RecordJPEG, RecordVideo:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown record format %q, expected png, jpg or avi", name)
+	}
+}
+
+// BoundingBox is a rectangle in frame pixels
+type BoundingBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// boundingBoxOf converts a rectangle, nil if it is empty
+func boundingBoxOf(rect image.Rectangle) *BoundingBox {
+	if rect.Empty() {
+		return nil
+	}
+	return &BoundingBox{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}
+}
+
+// DriveCommand is a Drive command as sent to the Roomba; a stop is velocity 0, radius 0
+type DriveCommand struct {
+	Velocity int16 `json:"velocity"`
+	Radius   int16 `json:"radius"`
+}
+
+// String returns the command in a readable form
+func (dc DriveCommand) String() string {
+	switch {
+	case dc.Velocity == 0 && dc.Radius == 0:
+		return "stop"
+	case dc.Radius == StraightRadius:
+		return fmt.Sprintf("drive %d mm/s straight", dc.Velocity)
+	case dc.Radius == SpinClockwiseRadius:
+		return fmt.Sprintf("spin clockwise %d mm/s", dc.Velocity)
+	case dc.Radius == SpinCounterClockwiseRadius:
+		return fmt.Sprintf("spin counter-clockwise %d mm/s", dc.Velocity)
+	default:
+		return fmt.Sprintf("drive %d mm/s radius %d mm", dc.Velocity, dc.Radius)
+	}
+}
+
+// RecordEntry is one line of a recording's log
+type RecordEntry struct {
+	Kind       string         `json:"kind"`                 // RecordKindDetection or RecordKindDrive
+	Seq        int            `json:"seq"`                  // Frame the entry is about
+	Time       time.Time      `json:"time"`                 // When the frame was read or the decision made
+	Frame      string         `json:"frame,omitempty"`      // Image file in the recording, for image sequences
+	Position   LinePosition   `json:"position"`             // Detected position
+	Offset     float64        `json:"offset,omitempty"`     // Detected horizontal offset, -1..1
+	Confidence float64        `json:"confidence,omitempty"` // Detection confidence, for detection entries
+	Area       float64        `json:"area,omitempty"`       // Largest contour area in pixels
+	BBox       *BoundingBox   `json:"bbox,omitempty"`       // Bounding box of the largest contour
+	Commands   []DriveCommand `json:"commands,omitempty"`   // Commands the tracker sent, for drive entries
+	Stopped    bool           `json:"stopped,omitempty"`    // Whether the tracker stopped itself after this decision
+}
+
+// recordItem is an entry waiting to be written, with its frame for detection entries
+type recordItem struct {
+	entry RecordEntry
+	frame *gocv.Mat
+}
+
+// Recorder writes camera frames and tracker decisions to a directory so a run can be
+// replayed later with different settings. Everything is written in the background so a
+// slow disk never holds up the tracker; frames are dropped, along with their log entry,
+// if it can't keep up.
+type Recorder struct {
+	dir          string
+	format       RecordFormat
+	logFile      *os.File
+	video        *gocv.VideoWriter
+	pending      []recordItem  // Entries waiting to be written, in order
+	queuedFrames int           // Frames among pending
+	wake         chan struct{} // Signals the writer that pending changed
+	done         chan struct{}
+	dropped      int
+	writeErr     error
+	closed       bool
+	mu           sync.Mutex
+}
+
+// NewRecorder creates the recording directory and starts writing to it
+func NewRecorder(dir string, format RecordFormat) (*Recorder, error) {
+	if _, err := ParseRecordFormat(string(format)); err != nil {
+		return nil, err
+	}
+	if format != RecordVideo {
+		if err := os.MkdirAll(filepath.Join(dir, RecordFramesDir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create recording: %v", err)
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, RecordLogFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording log: %v", err)
+	}
+
+	r := &Recorder{
+		dir:     dir,
+		format:  format,
+		logFile: logFile,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go r.writeLoop()
+	return r, nil
+}
+
+// NewTimestampedRecorder starts a recording in a new directory under parent named after the current time
+func NewTimestampedRecorder(parent string, format RecordFormat) (*Recorder, error) {
+	return NewRecorder(filepath.Join(parent, time.Now().Format(recordTimeLayout)), format)
+}
+
+// Dir returns the recording directory
+func (r *Recorder) Dir() string {
+	return r.dir
+}
+
+// recordFrame queues a copy of the frame and its detection, dropping both if the queue is full
+func (r *Recorder) recordFrame(frame gocv.Mat, detection DetectionResult) {
+	entry := RecordEntry{
+		Kind:       RecordKindDetection,
+		Seq:        detection.Seq,
+		Time:       detection.Time,
+		Position:   detection.Position,
+		Offset:     detection.Offset,
+		Confidence: detection.Confidence,
+		Area:       detection.Area,
+		BBox:       boundingBoxOf(detection.Rect),
+	}
+	if r.format != RecordVideo {
+		entry.Frame = filepath.Join(RecordFramesDir, fmt.Sprintf("%06d.%s", detection.Seq, r.format))
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	if r.queuedFrames >= recordQueueSize {
+		r.dropped++
+		r.mu.Unlock()
+		return
+	}
+	clone := frame.Clone()
+	r.pending = append(r.pending, recordItem{entry: entry, frame: &clone})
+	r.queuedFrames++
+	r.mu.Unlock()
+
+	r.signal()
+}
+
+// recordDecision queues a tracker decision without waiting. Decisions are small and never dropped.
+func (r *Recorder) recordDecision(entry RecordEntry) {
+	entry.Kind = RecordKindDrive
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.pending = append(r.pending, recordItem{entry: entry})
+	r.mu.Unlock()
+
+	r.signal()
+}
+
+// signal wakes the writer if it is waiting
+func (r *Recorder) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close waits for queued frames to be written and closes the recording
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	r.signal()
+	<-r.done
+
+	if r.video != nil {
+		r.video.Close()
+	}
+	err := r.logFile.Close()
+
+	if r.dropped > 0 {
+		log.Printf("Recording %s dropped %d frame(s), the disk could not keep up", r.dir, r.dropped)
+	}
+	if r.writeErr != nil {
+		return r.writeErr
+	}
+	return err
+}
+
+// writeLoop writes queued frames and log entries in order until the recorder is closed and nothing is left
+func (r *Recorder) writeLoop() {
+	defer close(r.done)
+
+	// Entries go straight to the file so the log is complete even if the process is killed
+	encoder := json.NewEncoder(r.logFile)
+	for {
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return
+			}
+			<-r.wake
+			continue
+		}
+		item := r.pending[0]
+		r.pending[0] = recordItem{}
+		r.pending = r.pending[1:]
+		if item.frame != nil {
+			r.queuedFrames--
+		}
+		r.mu.Unlock()
+
+		if item.frame != nil {
+			err := r.writeFrame(item.entry, *item.frame)
+			item.frame.Close()
+			if err != nil {
+				r.failed(err)
+				continue // A frame that wasn't saved can't be replayed, so leave out its entry
+			}
+		}
+
+		if err := encoder.Encode(item.entry); err != nil {
+			r.failed(fmt.Errorf("failed to write recording log: %v", err))
+		}
+	}
+}
+
+// writeFrame saves a frame as an image file or appends it to the video
+func (r *Recorder) writeFrame(entry RecordEntry, frame gocv.Mat) error {
+	if r.format != RecordVideo {
+		path := filepath.Join(r.dir, entry.Frame)
+		if ok := gocv.IMWrite(path, frame); !ok {
+			return fmt.Errorf("failed to write frame %s", path)
+		}
+		return nil
+	}
+
+	// The video size is only known once the first frame arrives
+	if r.video == nil {
+		path := filepath.Join(r.dir, RecordVideoFile)
+		video, err := gocv.VideoWriterFile(path, "MJPG", recordVideoFPS, frame.Cols(), frame.Rows(), true)
+		if err != nil {
+			return fmt.Errorf("failed to create video %s: %v", path, err)
+		}
+		r.video = video
+	}
+	return r.video.Write(frame)
+}
+
+// failed logs the first write error and keeps it for Close
+func (r *Recorder) failed(err error) {
+	if r.writeErr == nil {
+		log.Printf("Error recording to %s: %v", r.dir, err)
+		r.writeErr = err
+	}
+}
@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ReplayDiff is one place where a replay decided differently from the recording
+type ReplayDiff struct {
+	Seq      int    // Frame the difference is about
+	Field    string // What differs: position, commands, or frame if it is missing from the recording
+	Recorded string
+	Replayed string
+}
+
+// String returns the difference on one line
+func (rd ReplayDiff) String() string {
+	return fmt.Sprintf("frame %d: %s was %s, now %s", rd.Seq, rd.Field, rd.Recorded, rd.Replayed)
+}
+
+// ReplayReport summarizes a replay
+type ReplayReport struct {
+	Frames    int          // Frames detected again
+	Decisions int          // Tracker decisions made again
+	Diffs     []ReplayDiff // Every difference, in frame order
+}
+
+// String lists the differences, or says there were none
+func (rr *ReplayReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Replayed %d frame(s) and %d decision(s), %d difference(s)\n", rr.Frames, rr.Decisions, len(rr.Diffs))
+	for _, diff := range rr.Diffs {
+		fmt.Fprintf(&b, "  %s\n", diff)
+	}
+	return b.String()
+}
+
+// ReadRecording reads the log of a recording
+func ReadRecording(dir string) ([]RecordEntry, error) {
+	file, err := os.Open(filepath.Join(dir, RecordLogFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	var entries []RecordEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var entry RecordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", RecordLogFile, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %v", err)
+	}
+	return entries, nil
+}
+
+// recordedFrames reads back the frames of a recording in order
+type recordedFrames struct {
+	dir   string
+	video *gocv.VideoCapture
+}
+
+// read loads the frame of a detection entry into dst
+func (rf *recordedFrames) read(entry RecordEntry, dst *gocv.Mat) error {
+	if entry.Frame != "" {
+		img := gocv.IMRead(filepath.Join(rf.dir, entry.Frame), gocv.IMReadColor)
+		defer img.Close()
+		if img.Empty() {
+			return fmt.Errorf("failed to read frame %s", entry.Frame)
+		}
+		img.CopyTo(dst)
+		return nil
+	}
+
+	// Video recordings hold one frame per detection entry, in order
+	if rf.video == nil {
+		video, err := gocv.VideoCaptureFile(filepath.Join(rf.dir, RecordVideoFile))
+		if err != nil {
+			return fmt.Errorf("failed to open recorded video: %v", err)
+		}
+		rf.video = video
+	}
+	if ok := rf.video.Read(dst); !ok || dst.Empty() {
+		return fmt.Errorf("recorded video ends before frame %d", entry.Seq)
+	}
+	return nil
+}
+
+// Close closes the video, if one was opened
+func (rf *recordedFrames) Close() {
+	if rf.video != nil {
+		rf.video.Close()
+	}
+}
+
+// ReplayRecording runs the recorded frames through the detector and the recorded decisions
+// through the tracker using config, and reports where they now decide differently.
+// Decisions are replayed at their recorded times against a simulated Roomba, so no
+// camera or robot is needed.
+func ReplayRecording(dir string, config ColorTrackerConfig) (*ReplayReport, error) {
+	entries, err := ReadRecording(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("recording %s is empty", dir)
+	}
+
+	frames := &recordedFrames{dir: dir}
+	defer frames.Close()
+
+	config.DetectorConfig.ShowWindow = false
+	detector := NewColorDetectorWithSource(config.DetectorConfig, nil)
+	defer detector.Close()
+
+	buf := newDetectionBuffers(config.DetectorConfig)
+	defer buf.Close()
+
+	img := gocv.NewMat()
+	defer img.Close()
+
+	// The tracker drives a simulated Roomba; its commands are compared, not sent anywhere
+	roomba := NewRoombaWithTransport(NewFakeTransport())
+	roomba.WakeDelay = 0
+	roomba.SetMotionLease(0)
+	if err := roomba.Connect(); err != nil {
+		return nil, err
+	}
+	defer roomba.Close()
+
+	now := entries[0].Time
+	tracker := &ColorTracker{
+		config:        config,
+		roomba:        roomba,
+		running:       true,
+		stopChan:      make(chan struct{}),
+		lastPosition:  LineNotFound,
+		searchStarted: now,
+		state:         StateSearching,
+		steering:      NewPIDController(config.Steering),
+		clock:         func() time.Time { return now },
+	}
+
+	// Detect every recorded frame first, so each decision finds its frame however the log is ordered
+	report := &ReplayReport{}
+	detections := make(map[int]DetectionResult)
+	for _, entry := range entries {
+		if entry.Kind != RecordKindDetection {
+			continue
+		}
+		if err := frames.read(entry, &img); err != nil {
+			return nil, err
+		}
+		detection := detector.analyzeFrame(img, buf)
+		detection.Seq = entry.Seq
+		detection.Time = entry.Time
+		detections[entry.Seq] = detection
+		report.Frames++
+
+		if detection.Position != entry.Position {
+			report.Diffs = append(report.Diffs, ReplayDiff{
+				Seq:      entry.Seq,
+				Field:    "position",
+				Recorded: string(entry.Position),
+				Replayed: string(detection.Position),
+			})
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Kind != RecordKindDrive {
+			continue
+		}
+		if !tracker.isRunning() {
+			report.Diffs = append(report.Diffs, ReplayDiff{
+				Seq:      entry.Seq,
+				Field:    "commands",
+				Recorded: describeCommands(entry.Commands, entry.Stopped),
+				Replayed: "tracker already stopped",
+			})
+			continue
+		}
+
+		// A decision whose frame was dropped from the recording can't be checked, so say so
+		// rather than replaying it on what the tracker saw at the time
+		detection, ok := detections[entry.Seq]
+		if !ok {
+			report.Diffs = append(report.Diffs, ReplayDiff{
+				Seq:      entry.Seq,
+				Field:    "frame",
+				Recorded: "seen as " + string(entry.Position),
+				Replayed: "missing from recording",
+			})
+			continue
+		}
+		if detection.Position != LineNotFound {
+			tracker.colorEverFound = true
+		}
+
+		now = entry.Time
+		tracker.decide(detection)
+		report.Decisions++
+
+		recorded := describeCommands(entry.Commands, entry.Stopped)
+		replayed := describeCommands(tracker.issued, !tracker.isRunning())
+		if recorded != replayed {
+			report.Diffs = append(report.Diffs, ReplayDiff{
+				Seq:      entry.Seq,
+				Field:    "commands",
+				Recorded: recorded,
+				Replayed: replayed,
+			})
+		}
+	}
+
+	// Keep the differences about each frame together
+	sort.SliceStable(report.Diffs, func(i, j int) bool {
+		return report.Diffs[i].Seq < report.Diffs[j].Seq
+	})
+	return report, nil
+}
+
+// describeCommands lists a decision's commands for comparison and display
+func describeCommands(commands []DriveCommand, stopped bool) string {
+	parts := make([]string, 0, len(commands)+1)
+	for _, command := range commands {
+		parts = append(parts, command.String())
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no change")
+	}
+	if stopped {
+		parts = append(parts, "tracker stopped")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -2,7 +2,7 @@ package lib
 
 import (
 	"fmt"
-	"go.bug.st/serial"
+	"sync"
 	"time"
 )
 
@@ -11,63 +11,136 @@ const (
 )
 
 type RoombaCommands struct {
-	CmdStart   byte
-	CmdControl byte
-	CmdSafe    byte
-	CmdFull    byte
-	CmdPower   byte
-	CmdSpot    byte
-	CmdClean   byte
-	CmdMax     byte
-	CmdDrive   byte
-	CmdMotors  byte
-	CmdLeds    byte
-	CmdDock    byte
+	CmdStart             byte
+	CmdBaud              byte
+	CmdControl           byte
+	CmdSafe              byte
+	CmdFull              byte
+	CmdPower             byte
+	CmdSpot              byte
+	CmdClean             byte
+	CmdMax               byte
+	CmdDrive             byte
+	CmdMotors            byte
+	CmdLeds              byte
+	CmdSong              byte
+	CmdPlay              byte
+	CmdSensors           byte
+	CmdDock              byte
+	CmdDriveDirect       byte
+	CmdDrivePWM          byte
+	CmdStream            byte
+	CmdQueryList         byte
+	CmdPauseResumeStream byte
 }
 
 type Roomba struct {
-	port     serial.Port
-	portName string
-	baudRate int
-	Cmds     RoombaCommands
+	port           Transport
+	portName       string
+	baudRate       int
+	Cmds           RoombaCommands
+	WakeDelay      time.Duration // How long to wait after pulsing RTS before sending commands
+	ProbeBaudRates []int         // Rates Connect falls back to if the Roomba doesn't answer, empty skips the check
+	ReconnectDelay time.Duration // Pause between attempts to reopen a failed port, 0 disables reconnecting
+	AngleUnits     AngleUnits    // How this robot reports the angle sensor, used by RotateBy
+	poller         *SensorPoller // Background sensor poller, nil until polling starts
+	pollerMu       sync.Mutex
+	limits         SpeedLimits // Soft speed limit applied to every motion command
+	limitsMu       sync.RWMutex
+
+	// While the safety interlock is engaged every motion command except Stop is refused
+	interlock   *TripReason
+	interlockMu sync.RWMutex
+
+	// Last known and last commanded OI mode
+	mode          OIMode
+	requestedMode OIMode
+	modeMu        sync.RWMutex
+
+	// Motion watchdog, the robot stops when a motion command's lease runs out
+	leaseWindow   time.Duration
+	leaseActive   bool
+	leaseDeadline time.Time
+	leaseTimer    *time.Timer
+	leaseMu       sync.Mutex
+
+	// Connection supervision, the port is reopened after I/O errors
+	connState     ConnectionState
+	onConnChange  []func(ConnectionState)
+	usbID         *USBMatch // Adapter behind the port, to find it again under a new name
+	reconnectStop chan struct{}
+	reconnectDone chan struct{}
+	connMu        sync.Mutex
+
+	// All port I/O goes through a single writer goroutine fed by this queue
+	queue      *commandQueue
+	writerStop chan struct{}
+	writerDone chan struct{}
+	writerMu   sync.Mutex
 }
 
+// NewRoomba creates a Roomba that opens the named port on Connect.
+// Names starting with tcp:// connect to a serial bridge instead.
 func NewRoomba(portName string, baudRate int) *Roomba {
 	return &Roomba{
-		portName: portName,
-		baudRate: baudRate,
-		Cmds: RoombaCommands{
-			CmdStart:   128, // Start command
-			CmdControl: 130, // Control mode
-			CmdSafe:    131, // Safe mode
-			CmdFull:    132, // Full control mode
-			CmdPower:   133, // Power down
-			CmdSpot:    134, // Spot cleaning
-			CmdClean:   135, // Normal cleaning
-			CmdMax:     136, // Maximum cleaning
-			CmdDrive:   137, // Control wheels
-			CmdMotors:  138, // Control motors
-			CmdLeds:    139, // Control LEDs
-			CmdDock:    143, // Dock the robot
-		},
+		portName:       portName,
+		baudRate:       baudRate,
+		WakeDelay:      2 * time.Second,
+		ReconnectDelay: DefaultReconnectDelay,
+		limits:         DefaultSpeedLimits(),
+		queue:          newCommandQueue(),
+		Cmds:           defaultRoombaCommands(),
+	}
+}
+
+// NewRoombaWithTransport creates a Roomba that talks over an already open transport,
+// such as a FakeTransport in tests
+func NewRoombaWithTransport(transport Transport) *Roomba {
+	r := NewRoomba("", 0)
+	r.port = transport
+	return r
+}
+
+// defaultRoombaCommands returns the SCI opcodes, plus the Open Interface additions
+func defaultRoombaCommands() RoombaCommands {
+	return RoombaCommands{
+		CmdStart:             128, // Start command
+		CmdBaud:              129, // Change baud rate
+		CmdControl:           130, // Control mode
+		CmdSafe:              131, // Safe mode
+		CmdFull:              132, // Full control mode
+		CmdPower:             133, // Power down
+		CmdSpot:              134, // Spot cleaning
+		CmdClean:             135, // Normal cleaning
+		CmdMax:               136, // Maximum cleaning
+		CmdDrive:             137, // Control wheels
+		CmdMotors:            138, // Control motors
+		CmdLeds:              139, // Control LEDs
+		CmdSong:              140, // Define a song
+		CmdPlay:              141, // Play a song
+		CmdSensors:           142, // Request sensor data
+		CmdDock:              143, // Force-seeking-dock
+		CmdDriveDirect:       145, // Control each wheel's velocity (OI)
+		CmdDrivePWM:          146, // Control each wheel's PWM (OI)
+		CmdStream:            148, // Stream sensor packets (OI)
+		CmdQueryList:         149, // Request a list of sensor packets (OI)
+		CmdPauseResumeStream: 150, // Pause or resume the sensor stream (OI)
 	}
 }
 
 func (r *Roomba) Connect() error {
-	// Set up the serial port
-	mode := &serial.Mode{
-		BaudRate: r.baudRate,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
+	// Open the port unless a transport was supplied
+	if r.port == nil {
+		port, err := OpenTransport(r.portName, r.baudRate)
+		if err != nil {
+			return err
+		}
+		r.port = port
 	}
 
-	// Open the port
-	port, err := serial.Open(r.portName, mode)
-	if err != nil {
-		return fmt.Errorf("failed to open serial port: %v", err)
+	if err := r.configurePort(); err != nil {
+		return err
 	}
-	r.port = port
 
 	// Reset the Roomba by toggling RTS (if supported)
 	// Note: This may not work on all serial adapters
@@ -75,12 +148,41 @@ func (r *Roomba) Connect() error {
 	r.port.SetRTS(false)
 	time.Sleep(100 * time.Millisecond)
 	r.port.SetRTS(true)
-	time.Sleep(2 * time.Second)
+	time.Sleep(r.WakeDelay)
+
+	r.startWriter()
 
+	// Make sure the Roomba actually answers, searching for its baud rate if needed
+	if len(r.ProbeBaudRates) > 0 {
+		if err := r.probeBaudRate(); err != nil {
+			r.stopWriter()
+			return err
+		}
+	}
+
+	r.rememberUSBIdentity()
+	r.setConnectionState(ConnConnected)
+	return nil
+}
+
+// configurePort applies the port settings the protocol needs
+func (r *Roomba) configurePort() error {
+	// Bound reads so a missing sensor reply cannot block forever
+	if t, ok := r.port.(readTimeoutSetter); ok {
+		if err := t.SetReadTimeout(portReadTimeout); err != nil {
+			return fmt.Errorf("failed to set read timeout: %v", err)
+		}
+	}
 	return nil
 }
 
 func (r *Roomba) Close() error {
+	r.stopReconnecting()
+	r.cancelLease()
+	r.StopSensorPolling()
+	r.stopWriter()
+	r.setConnectionState(ConnDisconnected)
+
 	if r.port != nil {
 		return r.port.Close()
 	}
@@ -88,62 +190,151 @@ func (r *Roomba) Close() error {
 }
 
 func (r *Roomba) sendCommand(cmd byte) error {
-	_, err := r.port.Write([]byte{cmd})
-	time.Sleep(100 * time.Millisecond) // Give the Roomba time to process
+	_, err := r.submit(&command{
+		frame: []byte{cmd},
+		pace:  modeChangeDelay, // Give the Roomba time to process
+	})
 	return err
 }
 
+// sendDrivingCommand sends a command that starts the Roomba driving by itself, such as cleaning
+// or docking. Like motion commands, these are refused while the safety interlock is engaged.
+func (r *Roomba) sendDrivingCommand(cmd byte) error {
+	_, err := r.submit(&command{
+		frame:  []byte{cmd},
+		pace:   modeChangeDelay,
+		drives: true,
+	})
+	return err
+}
+
+// StartSensorPolling starts a background poller for the given packet group. If polling is
+// already running the existing poller is returned, or ErrPollingRunning if it polls differently;
+// replacing it would leave the safety supervisor and other subscribers watching a dead poller.
+func (r *Roomba) StartSensorPolling(packetID byte, interval time.Duration) (*SensorPoller, error) {
+	r.pollerMu.Lock()
+	defer r.pollerMu.Unlock()
+
+	poller := NewSensorPoller(r, packetID, interval)
+	if r.poller != nil {
+		if r.poller.packetID != poller.packetID || r.poller.interval != poller.interval {
+			return nil, fmt.Errorf("%w: packet %d every %v", ErrPollingRunning, r.poller.packetID, r.poller.interval)
+		}
+		return r.poller, nil
+	}
+
+	r.poller = poller
+	r.poller.Start()
+	return r.poller, nil
+}
+
+// StopSensorPolling stops the background poller if one is running and closes its
+// subscriptions, so subscribers know no more readings are coming
+func (r *Roomba) StopSensorPolling() {
+	r.pollerMu.Lock()
+	defer r.pollerMu.Unlock()
+
+	if r.poller != nil {
+		r.poller.Stop()
+		r.poller.unsubscribeAll()
+		r.poller = nil
+	}
+}
+
+// Poller returns the running sensor poller, or nil if polling has not been started
+func (r *Roomba) Poller() *SensorPoller {
+	r.pollerMu.Lock()
+	defer r.pollerMu.Unlock()
+	return r.poller
+}
+
 func (r *Roomba) Start() error {
-	return r.sendCommand(r.Cmds.CmdStart)
+	return r.sendModeCommand(r.Cmds.CmdStart, OIModePassive)
 }
 
 func (r *Roomba) Control() error {
-	return r.sendCommand(r.Cmds.CmdControl)
+	return r.sendModeCommand(r.Cmds.CmdControl, OIModeSafe)
 }
 
 func (r *Roomba) SafeMode() error {
-	return r.sendCommand(r.Cmds.CmdSafe)
+	return r.sendModeCommand(r.Cmds.CmdSafe, OIModeSafe)
 }
 
 func (r *Roomba) FullMode() error {
-	return r.sendCommand(r.Cmds.CmdFull)
+	return r.sendModeCommand(r.Cmds.CmdFull, OIModeFull)
 }
 
 func (r *Roomba) Clean() error {
-	return r.sendCommand(r.Cmds.CmdClean)
+	return r.sendDrivingModeCommand(r.Cmds.CmdClean, OIModePassive)
 }
 
 func (r *Roomba) SpotClean() error {
-	return r.sendCommand(r.Cmds.CmdSpot)
+	return r.sendDrivingModeCommand(r.Cmds.CmdSpot, OIModePassive)
 }
 
 func (r *Roomba) MaxClean() error {
-	return r.sendCommand(r.Cmds.CmdMax)
+	return r.sendDrivingModeCommand(r.Cmds.CmdMax, OIModePassive)
 }
 
+// Dock sends the robot looking for its charging base
 func (r *Roomba) Dock() error {
-	return r.sendCommand(r.Cmds.CmdDock)
+	return r.ForceSeekingDock()
 }
 
 func (r *Roomba) PowerOff() error {
-	return r.sendCommand(r.Cmds.CmdPower)
+	return r.sendModeCommand(r.Cmds.CmdPower, OIModePassive)
 }
 
 // Drive controls the Roomba's movement
-// velocity: -500 to 500 mm/s
-// radius: -2000 to 2000 mm, special cases: 32768=straight, 1=clockwise, -1=counterclockwise
+// velocity: -500 to 500 mm/s, further bounded by the soft speed limit
+// radius: -2000 to 2000 mm, special cases: StraightRadius (32767 or 0x8000)=straight, -1=clockwise, 1=counterclockwise
 func (r *Roomba) Drive(velocity int16, radius int16) error {
-	command := []byte{
+	return r.drive(velocity, radius, false)
+}
+
+// drive sends a Drive command; override lets the safety supervisor move while the interlock is engaged
+func (r *Roomba) drive(velocity int16, radius int16, override bool) error {
+	velocity, err := r.limitVelocity("velocity", velocity)
+	if err != nil {
+		return err
+	}
+	radius, err = r.limitRadius(radius)
+	if err != nil {
+		return err
+	}
+
+	frame := []byte{
 		r.Cmds.CmdDrive,
 		byte(velocity >> 8),   // Velocity high byte
 		byte(velocity & 0xFF), // Velocity low byte
 		byte(radius >> 8),     // Radius high byte
 		byte(radius & 0xFF),   // Radius low byte
 	}
-	_, err := r.port.Write(command)
+	_, err = r.submit(&command{frame: frame, motion: true, override: override})
 	return err
 }
 
+// Spin turns in place at the given wheel speed in mm/s.
+// Positive speeds turn counter-clockwise (left), negative speeds clockwise (right).
+func (r *Roomba) Spin(speed int16) error {
+	// Limit before negating, since -32768 has no positive counterpart
+	speed, err := r.limitVelocity("speed", speed)
+	if err != nil {
+		return err
+	}
+	if speed < 0 {
+		return r.Drive(-speed, SpinClockwiseRadius)
+	}
+	return r.Drive(speed, SpinCounterClockwiseRadius)
+}
+
+// Stop halts the wheels, jumping ahead of any queued commands
+// and discarding motion commands that have not been sent yet
 func (r *Roomba) Stop() error {
-	return r.Drive(0, 0)
+	_, err := r.submit(&command{
+		frame:  []byte{r.Cmds.CmdDrive, 0, 0, 0, 0},
+		urgent: true,
+		stop:   true,
+	})
+	return err
 }
@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// baudChangeDelay is how long the Roomba needs before it talks at a new baud rate
+const baudChangeDelay = 100 * time.Millisecond
+
+// baudCodes maps supported baud rates to the code sent with the Baud command
+var baudCodes = map[int]byte{
+	300:    0,
+	600:    1,
+	1200:   2,
+	2400:   3,
+	4800:   4,
+	9600:   5,
+	14400:  6,
+	19200:  7,
+	28800:  8,
+	38400:  9,
+	57600:  10,
+	115200: 11,
+}
+
+// supportedBaudRates lists the rates the Baud command accepts, slowest first
+func supportedBaudRates() string {
+	rates := make([]int, 0, len(baudCodes))
+	for rate := range baudCodes {
+		rates = append(rates, rate)
+	}
+	sort.Ints(rates)
+
+	names := make([]string, len(rates))
+	for i, rate := range rates {
+		names[i] = strconv.Itoa(rate)
+	}
+	return strings.Join(names, ", ")
+}
+
+// MotorBits selects which cleaning motors are on
+type MotorBits byte
+
+const (
+	MotorSideBrush MotorBits = 0x01
+	MotorVacuum    MotorBits = 0x02
+	MotorMainBrush MotorBits = 0x04
+
+	MotorsOff MotorBits = 0
+	MotorsAll           = MotorSideBrush | MotorVacuum | MotorMainBrush
+)
+
+// LEDBits selects which LEDs are lit
+type LEDBits byte
+
+const (
+	LEDDirtDetect  LEDBits = 0x01
+	LEDMax         LEDBits = 0x02
+	LEDClean       LEDBits = 0x04
+	LEDSpot        LEDBits = 0x08
+	LEDStatusRed   LEDBits = 0x10
+	LEDStatusGreen LEDBits = 0x20
+	LEDStatusAmber         = LEDStatusRed | LEDStatusGreen
+
+	LEDsOff LEDBits = 0
+	ledMask         = LEDDirtDetect | LEDMax | LEDClean | LEDSpot | LEDStatusAmber
+)
+
+// Power LED colors for SetLEDs
+const (
+	PowerColorGreen byte = 0
+	PowerColorAmber byte = 128
+	PowerColorRed   byte = 255
+)
+
+// Song limits from the SCI specification
+const (
+	MaxSongSlot        byte = 15  // Songs are numbered 0-15
+	MaxSongNotes            = 16  // Each song holds up to 16 notes
+	MinNoteNumber      byte = 31  // G1
+	MaxNoteNumber      byte = 127 // G9
+	RestNoteNumber     byte = 0   // Any number outside 31-127 is silent
+	NoteTicksPerSecond      = 64  // Note durations are in 1/64ths of a second
+)
+
+// Note is a single note of a song
+type Note struct {
+	Number   byte // MIDI note number 31-127, or RestNoteNumber for silence
+	Duration byte // Length in 1/64ths of a second
+}
+
+// MaxWheelPWM is the largest duty cycle accepted by DrivePWM
+const MaxWheelPWM int16 = 255
+
+// WheelBase is the distance between the Roomba's drive wheels in mm
+const WheelBase = 258.0
+
+// encodeInt16 returns the high and low bytes of a signed 16-bit value
+func encodeInt16(v int16) []byte {
+	return []byte{byte(v >> 8), byte(v & 0xFF)}
+}
+
+// Baud tells the Roomba to switch to a new baud rate.
+// The port must be reopened at the new rate before sending anything else.
+func (r *Roomba) Baud(rate int) error {
+	code, ok := baudCodes[rate]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d, expected one of %s", rate, supportedBaudRates())
+	}
+
+	_, err := r.submit(&command{
+		frame: []byte{r.Cmds.CmdBaud, code},
+		pace:  baudChangeDelay,
+	})
+	return err
+}
+
+// Motors turns the side brush, vacuum and main brush on or off
+func (r *Roomba) Motors(bits MotorBits) error {
+	if bits&^MotorsAll != 0 {
+		return fmt.Errorf("invalid motor bits %08b", byte(bits))
+	}
+
+	_, err := r.submit(&command{frame: []byte{r.Cmds.CmdMotors, byte(bits)}})
+	return err
+}
+
+// SetLEDs sets the indicator LEDs and the power LED color (0 green to 255 red) and intensity (0-255)
+func (r *Roomba) SetLEDs(bits LEDBits, powerColor, powerIntensity byte) error {
+	if bits&^ledMask != 0 {
+		return fmt.Errorf("invalid LED bits %08b", byte(bits))
+	}
+
+	_, err := r.submit(&command{frame: []byte{r.Cmds.CmdLeds, byte(bits), powerColor, powerIntensity}})
+	return err
+}
+
+// DefineSong stores up to 16 notes in one of the 16 song slots
+func (r *Roomba) DefineSong(slot byte, notes []Note) error {
+	if slot > MaxSongSlot {
+		return fmt.Errorf("song slot %d out of range 0-%d", slot, MaxSongSlot)
+	}
+	if len(notes) == 0 || len(notes) > MaxSongNotes {
+		return fmt.Errorf("song must have 1-%d notes, got %d", MaxSongNotes, len(notes))
+	}
+
+	frame := []byte{r.Cmds.CmdSong, slot, byte(len(notes))}
+	for i, note := range notes {
+		if note.Number != RestNoteNumber && (note.Number < MinNoteNumber || note.Number > MaxNoteNumber) {
+			return fmt.Errorf("note %d: number %d out of range %d-%d", i, note.Number, MinNoteNumber, MaxNoteNumber)
+		}
+		frame = append(frame, note.Number, note.Duration)
+	}
+
+	_, err := r.submit(&command{frame: frame})
+	return err
+}
+
+// PlaySong plays a song previously stored with DefineSong
+func (r *Roomba) PlaySong(slot byte) error {
+	if slot > MaxSongSlot {
+		return fmt.Errorf("song slot %d out of range 0-%d", slot, MaxSongSlot)
+	}
+
+	_, err := r.submit(&command{frame: []byte{r.Cmds.CmdPlay, slot}})
+	return err
+}
+
+// ForceSeekingDock makes the Roomba look for its charging base, handing control back to it
+func (r *Roomba) ForceSeekingDock() error {
+	return r.sendDrivingModeCommand(r.Cmds.CmdDock, OIModePassive)
+}
+
+// DriveDirect sets each wheel's velocity independently, -500 to 500 mm/s
+// further bounded by the soft speed limit (OI only)
+func (r *Roomba) DriveDirect(left, right int16) error {
+	left, err := r.limitVelocity("left wheel velocity", left)
+	if err != nil {
+		return err
+	}
+	right, err = r.limitVelocity("right wheel velocity", right)
+	if err != nil {
+		return err
+	}
+
+	// The right wheel comes first on the wire
+	frame := append([]byte{r.Cmds.CmdDriveDirect}, encodeInt16(right)...)
+	frame = append(frame, encodeInt16(left)...)
+
+	_, err = r.submit(&command{frame: frame, motion: true})
+	return err
+}
+
+// Twist drives with a forward speed in mm/s and a turn rate in rad/s (counter-clockwise is positive).
+// If either wheel would exceed the speed limit both are scaled down together so the arc is preserved.
+func (r *Roomba) Twist(linear, angular float64) error {
+	left, right, err := twistToWheels(linear, angular, r.SpeedLimits().MaxVelocity)
+	if err != nil {
+		return err
+	}
+	return r.DriveDirect(left, right)
+}
+
+// twistToWheels converts a forward speed and turn rate to wheel velocities no faster than limit
+func twistToWheels(linear, angular float64, limit int16) (int16, int16, error) {
+	left := linear - angular*WheelBase/2
+	right := linear + angular*WheelBase/2
+
+	// NaN would slip past the scaling below and has no int16 value
+	if !isFinite(left) || !isFinite(right) {
+		return 0, 0, fmt.Errorf("%w: twist %v mm/s, %v rad/s", ErrVelocityOutOfRange, linear, angular)
+	}
+
+	// Scale both wheels by the same factor to keep the same curvature
+	fastest := math.Max(math.Abs(left), math.Abs(right))
+	if max := float64(limit); fastest > max {
+		left *= max / fastest
+		right *= max / fastest
+	}
+
+	return int16(math.Round(left)), int16(math.Round(right)), nil
+}
+
+// isFinite reports whether a value is neither NaN nor infinite
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// DrivePWM sets each wheel's motor duty cycle independently, -255 to 255 (OI only)
+func (r *Roomba) DrivePWM(left, right int16) error {
+	policy := r.SpeedLimits().Policy
+	left, err := applyLimit("left wheel PWM", left, MaxWheelPWM, policy, ErrVelocityOutOfRange)
+	if err != nil {
+		return err
+	}
+	right, err = applyLimit("right wheel PWM", right, MaxWheelPWM, policy, ErrVelocityOutOfRange)
+	if err != nil {
+		return err
+	}
+
+	// The right wheel comes first on the wire
+	frame := append([]byte{r.Cmds.CmdDrivePWM}, encodeInt16(right)...)
+	frame = append(frame, encodeInt16(left)...)
+
+	_, err = r.submit(&command{frame: frame, motion: true})
+	return err
+}
+
+// Stream asks the Roomba to send the given sensor packets every 15 ms (OI only).
+// Streamed data arrives unrequested, so stop any SensorPoller before using it.
+func (r *Roomba) Stream(packetIDs ...byte) error {
+	if len(packetIDs) == 0 || len(packetIDs) > 255 {
+		return fmt.Errorf("stream needs 1-255 packet IDs, got %d", len(packetIDs))
+	}
+
+	frame := append([]byte{r.Cmds.CmdStream, byte(len(packetIDs))}, packetIDs...)
+	_, err := r.submit(&command{frame: frame})
+	return err
+}
+
+// PauseStream stops the sensor stream without forgetting the packet list (OI only)
+func (r *Roomba) PauseStream() error {
+	_, err := r.submit(&command{frame: []byte{r.Cmds.CmdPauseResumeStream, 0}})
+	return err
+}
+
+// ResumeStream restarts a paused sensor stream (OI only)
+func (r *Roomba) ResumeStream() error {
+	_, err := r.submit(&command{frame: []byte{r.Cmds.CmdPauseResumeStream, 1}})
+	return err
+}
+
+// QueryList requests several sensor packets in one round trip and decodes each one (OI only)
+func (r *Roomba) QueryList(packetIDs ...byte) ([]SensorData, error) {
+	if len(packetIDs) == 0 || len(packetIDs) > 255 {
+		return nil, fmt.Errorf("query list needs 1-255 packet IDs, got %d", len(packetIDs))
+	}
+
+	total := 0
+	for _, id := range packetIDs {
+		length, ok := sensorPacketLengths[id]
+		if !ok {
+			return nil, fmt.Errorf("unsupported sensor packet %d", id)
+		}
+		total += length
+	}
+
+	frame := append([]byte{r.Cmds.CmdQueryList, byte(len(packetIDs))}, packetIDs...)
+	reply, err := r.submit(&command{frame: frame, replyLen: total})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sensor packets: %w", err)
+	}
+
+	now := time.Now()
+	results := make([]SensorData, 0, len(packetIDs))
+	for _, id := range packetIDs {
+		length := sensorPacketLengths[id]
+		results = append(results, decodeSensorPacket(id, reply[:length], now))
+		reply = reply[length:]
+	}
+	return results, nil
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+// newTestRoomba connects a Roomba to a fake transport and clears what Connect wrote
+func newTestRoomba(t *testing.T) (*Roomba, *FakeTransport) {
+	t.Helper()
+
+	transport := NewFakeTransport()
+	roomba := NewRoombaWithTransport(transport)
+	roomba.WakeDelay = 0
+	roomba.SetMotionLease(0)
+	if err := roomba.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { roomba.Close() })
+
+	transport.Reset()
+	return roomba, transport
+}
+
+// lastFrame returns the most recent frame written, failing the test if there is none
+func lastFrame(t *testing.T, transport *FakeTransport) []byte {
+	t.Helper()
+
+	frames := transport.Frames()
+	if len(frames) == 0 {
+		t.Fatal("nothing was written")
+	}
+	return frames[len(frames)-1]
+}
+
+func TestMotionFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(r *Roomba) error
+		want []byte
+	}{
+		{
+			name: "drive straight",
+			send: func(r *Roomba) error { return r.Drive(200, StraightRadius) },
+			want: []byte{137, 0x00, 0xC8, 0x7F, 0xFF},
+		},
+		{
+			name: "drive straight alternate radius",
+			send: func(r *Roomba) error { return r.Drive(100, StraightRadiusAlt) },
+			want: []byte{137, 0x00, 0x64, 0x7F, 0xFF},
+		},
+		{
+			name: "drive backwards on a curve",
+			send: func(r *Roomba) error { return r.Drive(-200, 500) },
+			want: []byte{137, 0xFF, 0x38, 0x01, 0xF4},
+		},
+		{
+			name: "spin counter-clockwise",
+			send: func(r *Roomba) error { return r.Spin(100) },
+			want: []byte{137, 0x00, 0x64, 0x00, 0x01},
+		},
+		{
+			name: "spin clockwise",
+			send: func(r *Roomba) error { return r.Spin(-100) },
+			want: []byte{137, 0x00, 0x64, 0xFF, 0xFF},
+		},
+		{
+			name: "drive direct sends the right wheel first",
+			send: func(r *Roomba) error { return r.DriveDirect(100, -100) },
+			want: []byte{145, 0xFF, 0x9C, 0x00, 0x64},
+		},
+		{
+			name: "stop",
+			send: func(r *Roomba) error { return r.Stop() },
+			want: []byte{137, 0x00, 0x00, 0x00, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomba, transport := newTestRoomba(t)
+			if err := tt.send(roomba); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := lastFrame(t, transport); !bytes.Equal(got, tt.want) {
+				t.Errorf("frame = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpinLimitsBeforeNegating(t *testing.T) {
+	roomba, transport := newTestRoomba(t)
+
+	if err := roomba.Spin(math.MinInt16); !errors.Is(err, ErrVelocityOutOfRange) {
+		t.Fatalf("reject policy: got %v, want ErrVelocityOutOfRange", err)
+	}
+
+	if err := roomba.SetSpeedLimits(SpeedLimits{MaxVelocity: MaxVelocity, Policy: SpeedLimitClamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roomba.Spin(math.MinInt16); err != nil {
+		t.Fatalf("clamp policy: %v", err)
+	}
+	want := []byte{137, 0x01, 0xF4, 0xFF, 0xFF} // Clockwise at full speed
+	if got := lastFrame(t, transport); !bytes.Equal(got, want) {
+		t.Errorf("frame = % X, want % X", got, want)
+	}
+}
+
+func TestTwistRejectsNonFinite(t *testing.T) {
+	tests := []struct {
+		name            string
+		linear, angular float64
+	}{
+		{"NaN turn rate", 100, math.NaN()},
+		{"NaN speed", math.NaN(), 0},
+		{"infinite turn rate", 0, math.Inf(1)},
+		{"infinite speed", math.Inf(-1), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomba, transport := newTestRoomba(t)
+			if err := roomba.Twist(tt.linear, tt.angular); !errors.Is(err, ErrVelocityOutOfRange) {
+				t.Errorf("got %v, want ErrVelocityOutOfRange", err)
+			}
+			if frames := transport.Frames(); len(frames) != 0 {
+				t.Errorf("wrote % X, want nothing", frames)
+			}
+		})
+	}
+}
+
+func TestTwistToWheels(t *testing.T) {
+	tests := []struct {
+		name            string
+		linear, angular float64
+		limit           int16
+		left, right     int16
+	}{
+		{"straight", 200, 0, 500, 200, 200},
+		{"turn left in place", 0, 1, 500, -129, 129},
+		{"scaled to the limit", 400, 2, 500, 108, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left, right, err := twistToWheels(tt.linear, tt.angular, tt.limit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if left != tt.left || right != tt.right {
+				t.Errorf("wheels = %d, %d, want %d, %d", left, right, tt.left, tt.right)
+			}
+		})
+	}
+}
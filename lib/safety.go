@@ -0,0 +1,356 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// safetyBufferSize is how many readings the supervisor can fall behind before dropping old ones
+const safetyBufferSize = 8
+
+// ErrSafetyInterlock is returned for motion commands refused while the safety interlock is engaged
+var ErrSafetyInterlock = errors.New("safety interlock engaged")
+
+// TripCause identifies the kind of hazard that tripped the safety interlock
+type TripCause string
+
+const (
+	TripBump      TripCause = "bump"
+	TripCliff     TripCause = "cliff"
+	TripWheelDrop TripCause = "wheel drop"
+	TripNoSensors TripCause = "sensor feedback lost" // The poller stopped, so hazards can't be seen
+)
+
+// TripReason describes why the safety interlock was engaged
+type TripReason struct {
+	Cause   TripCause // Kind of hazard
+	Sensors []string  // Which sensors fired, e.g. "left", "front right"
+	Time    time.Time // When the hazard was detected
+}
+
+// String returns a human readable trip reason
+func (tr TripReason) String() string {
+	if len(tr.Sensors) == 0 {
+		return string(tr.Cause)
+	}
+	return fmt.Sprintf("%s (%s)", tr.Cause, strings.Join(tr.Sensors, ", "))
+}
+
+// SafetyConfig holds configuration for the safety supervisor
+type SafetyConfig struct {
+	BackoffDistance int   `json:"backoff_distance"` // How far to reverse after a bump or cliff in mm, 0 to stay put
+	BackoffSpeed    int16 `json:"backoff_speed"`    // Speed for the backoff in mm/s
+}
+
+// DefaultSafetyConfig returns reasonable default settings
+func DefaultSafetyConfig() SafetyConfig {
+	return SafetyConfig{
+		BackoffDistance: 100, // Enough to clear the bumper or the cliff edge
+		BackoffSpeed:    100,
+	}
+}
+
+// SafetySupervisor watches the sensor stream and stops the robot on bumps, cliffs and wheel drops.
+// Once tripped, the Roomba refuses motion commands until Reset is called with the hazard cleared.
+type SafetySupervisor struct {
+	config        SafetyConfig
+	roomba        *Roomba
+	poller        *SensorPoller
+	readings      <-chan SensorData
+	onTrip        []func(TripReason)
+	cancelBackoff context.CancelFunc
+	running       bool
+	mu            sync.Mutex
+	stopChan      chan struct{}
+	doneChan      chan struct{}
+}
+
+// NewSafetySupervisor creates a supervisor for the given Roomba
+func NewSafetySupervisor(roomba *Roomba, config SafetyConfig) *SafetySupervisor {
+	return &SafetySupervisor{
+		config: config,
+		roomba: roomba,
+	}
+}
+
+// OnTrip registers a callback run whenever the interlock trips, e.g. to cancel a ColorTracker
+func (ss *SafetySupervisor) OnTrip(callback func(TripReason)) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.onTrip = append(ss.onTrip, callback)
+}
+
+// Start begins watching the Roomba's sensor poller
+func (ss *SafetySupervisor) Start() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.running {
+		return nil
+	}
+
+	// Hazards are reported in packet 1, which group 0 includes
+	poller := ss.roomba.Poller()
+	if poller == nil || (poller.PacketID() != SensorPacketAll && poller.PacketID() != SensorPacketPhysical) {
+		return ErrNoSensorFeedback
+	}
+
+	ss.running = true
+	ss.poller = poller
+	ss.readings = poller.SubscribeBuffered(safetyBufferSize)
+	ss.stopChan = make(chan struct{})
+	ss.doneChan = make(chan struct{})
+
+	go ss.watchLoop(ss.readings, ss.stopChan, ss.doneChan)
+	return nil
+}
+
+// Stop stops watching the sensors. An engaged interlock stays engaged.
+func (ss *SafetySupervisor) Stop() {
+	ss.mu.Lock()
+	if !ss.running {
+		ss.mu.Unlock()
+		return
+	}
+	ss.running = false
+	close(ss.stopChan)
+	done := ss.doneChan
+	ss.poller.Unsubscribe(ss.readings)
+	if ss.cancelBackoff != nil {
+		ss.cancelBackoff()
+	}
+	ss.mu.Unlock()
+
+	<-done
+}
+
+// Tripped returns the reason the interlock is engaged, if it is
+func (ss *SafetySupervisor) Tripped() (TripReason, bool) {
+	return ss.roomba.Interlock()
+}
+
+// Reset releases the interlock once the latest reading shows no hazard
+func (ss *SafetySupervisor) Reset() error {
+	if _, tripped := ss.roomba.Interlock(); !tripped {
+		return nil
+	}
+
+	ss.mu.Lock()
+	poller, running := ss.poller, ss.running
+	ss.mu.Unlock()
+
+	// A reading from a poller the supervisor no longer watches may be long out of date
+	if poller == nil || !running {
+		return fmt.Errorf("%w: safety supervisor is not watching the sensors", ErrNoSensorFeedback)
+	}
+
+	data, ok := poller.Latest()
+	if !ok {
+		return ErrNoSensorFeedback
+	}
+	if reason, hazard := checkHazards(data); hazard {
+		return fmt.Errorf("cannot reset while hazard is present: %s", reason)
+	}
+
+	ss.roomba.releaseInterlock()
+	log.Println("Safety interlock reset")
+	return nil
+}
+
+// watchLoop trips the interlock as soon as a reading shows a hazard
+func (ss *SafetySupervisor) watchLoop(readings <-chan SensorData, stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case data, ok := <-readings:
+			if !ok {
+				ss.feedbackLost(stopChan)
+				return
+			}
+
+			reason, hazard := checkHazards(data)
+			if !hazard {
+				continue
+			}
+
+			// While backing away the original hazard is expected to linger, so only
+			// something worse than what tripped the interlock interrupts the backoff
+			if current, tripped := ss.roomba.Interlock(); tripped {
+				if worseHazard(reason, current) {
+					ss.abortBackoff()
+					ss.roomba.Stop()
+					log.Printf("Safety backoff aborted: %s", reason)
+				}
+				continue
+			}
+
+			// Refuse further motion before stopping, so nothing queued behind the stop drives on
+			ss.roomba.engageInterlock(reason)
+			if err := ss.roomba.Stop(); err != nil {
+				log.Printf("Error stopping Roomba after %s: %v", reason, err)
+			}
+
+			ss.trip(reason)
+		}
+	}
+}
+
+// feedbackLost engages the interlock when the poller closes the subscription while the
+// supervisor is still meant to be watching, since hazards can no longer be seen
+func (ss *SafetySupervisor) feedbackLost(stopChan chan struct{}) {
+	ss.mu.Lock()
+	select {
+	case <-stopChan:
+		ss.mu.Unlock()
+		return // Stop closed the subscription
+	default:
+	}
+	ss.running = false
+	ss.mu.Unlock()
+
+	reason := TripReason{Cause: TripNoSensors, Time: time.Now()}
+	ss.roomba.engageInterlock(reason)
+	if err := ss.roomba.Stop(); err != nil {
+		log.Printf("Error stopping Roomba after %s: %v", reason, err)
+	}
+	ss.trip(reason)
+}
+
+// trip notifies callbacks and starts the backoff once the interlock is engaged and the robot stopped
+func (ss *SafetySupervisor) trip(reason TripReason) {
+	log.Printf("Safety interlock tripped: %s", reason)
+
+	ss.mu.Lock()
+	callbacks := append(([]func(TripReason))(nil), ss.onTrip...)
+	ss.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(reason)
+	}
+
+	// Back away from bumps and cliffs, but never move a robot that has been picked up
+	// or one whose sensors can't be seen
+	if reason.Cause == TripWheelDrop || reason.Cause == TripNoSensors || ss.config.BackoffDistance <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ss.mu.Lock()
+	ss.cancelBackoff = cancel
+	ss.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		if err := ss.roomba.backOff(ctx, ss.config.BackoffDistance, ss.config.BackoffSpeed); err != nil {
+			log.Printf("Safety backoff did not complete: %v", err)
+		}
+	}()
+}
+
+// abortBackoff cancels a backoff in progress
+func (ss *SafetySupervisor) abortBackoff() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.cancelBackoff != nil {
+		ss.cancelBackoff()
+		ss.cancelBackoff = nil
+	}
+}
+
+// checkHazards reports the most serious hazard in a reading, if any
+func checkHazards(data SensorData) (TripReason, bool) {
+	// Packets 2 and 3 carry no hazard sensors
+	if data.PacketID != SensorPacketAll && data.PacketID != SensorPacketPhysical {
+		return TripReason{}, false
+	}
+
+	reason := TripReason{Time: data.Timestamp}
+	switch {
+	case data.WheelDropped():
+		reason.Cause = TripWheelDrop
+		reason.Sensors = firedSensors(map[string]bool{
+			"left":   data.WheelDropLeft,
+			"right":  data.WheelDropRight,
+			"caster": data.WheelDropCaster,
+		})
+	case data.CliffDetected():
+		reason.Cause = TripCliff
+		reason.Sensors = firedSensors(map[string]bool{
+			"left":        data.CliffLeft,
+			"front left":  data.CliffFrontLeft,
+			"front right": data.CliffFrontRight,
+			"right":       data.CliffRight,
+		})
+	case data.Bumped():
+		reason.Cause = TripBump
+		reason.Sensors = firedSensors(map[string]bool{
+			"left":  data.BumpLeft,
+			"right": data.BumpRight,
+		})
+	default:
+		return TripReason{}, false
+	}
+
+	return reason, true
+}
+
+// worseHazard reports whether a new hazard should interrupt the response to the current one
+func worseHazard(next, current TripReason) bool {
+	return next.Cause == TripWheelDrop || (next.Cause == TripCliff && current.Cause == TripBump)
+}
+
+// firedSensors lists the names of the sensors that are set, in a stable order
+func firedSensors(sensors map[string]bool) []string {
+	order := []string{"left", "front left", "front right", "right", "caster"}
+
+	var fired []string
+	for _, name := range order {
+		if sensors[name] {
+			fired = append(fired, name)
+		}
+	}
+	return fired
+}
+
+// Interlock returns the reason the safety interlock is engaged, if it is
+func (r *Roomba) Interlock() (TripReason, bool) {
+	r.interlockMu.RLock()
+	defer r.interlockMu.RUnlock()
+
+	if r.interlock == nil {
+		return TripReason{}, false
+	}
+	return *r.interlock, true
+}
+
+// engageInterlock refuses all motion commands until released
+func (r *Roomba) engageInterlock(reason TripReason) {
+	r.interlockMu.Lock()
+	defer r.interlockMu.Unlock()
+	r.interlock = &reason
+}
+
+// releaseInterlock allows motion commands again
+func (r *Roomba) releaseInterlock() {
+	r.interlockMu.Lock()
+	defer r.interlockMu.Unlock()
+	r.interlock = nil
+}
+
+// backOff reverses straight for the given distance, bypassing the interlock
+func (r *Roomba) backOff(ctx context.Context, mm int, speed int16) error {
+	return r.runClosedLoop(ctx, float64(mm), speed, func(data SensorData) float64 {
+		return -float64(data.Distance)
+	}, func(s int16) error {
+		return r.drive(-s, StraightRadius, true)
+	}, approachDistance)
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInterlockRefusesMotion(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(r *Roomba) error
+	}{
+		{"drive", func(r *Roomba) error { return r.Drive(100, StraightRadius) }},
+		{"drive direct", func(r *Roomba) error { return r.DriveDirect(100, 100) }},
+		{"spin", func(r *Roomba) error { return r.Spin(100) }},
+		{"twist", func(r *Roomba) error { return r.Twist(100, 0.5) }},
+		{"clean", func(r *Roomba) error { return r.Clean() }},
+		{"spot clean", func(r *Roomba) error { return r.SpotClean() }},
+		{"max clean", func(r *Roomba) error { return r.MaxClean() }},
+		{"dock", func(r *Roomba) error { return r.Dock() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomba, transport := newTestRoomba(t)
+			roomba.engageInterlock(TripReason{Cause: TripCliff, Sensors: []string{"front left"}})
+
+			if err := tt.send(roomba); !errors.Is(err, ErrSafetyInterlock) {
+				t.Fatalf("got %v, want ErrSafetyInterlock", err)
+			}
+			if frames := transport.Frames(); len(frames) != 0 {
+				t.Fatalf("wrote % X while the interlock was engaged", frames)
+			}
+
+			roomba.releaseInterlock()
+			if err := tt.send(roomba); err != nil {
+				t.Fatalf("after release: %v", err)
+			}
+			if frames := transport.Frames(); len(frames) == 0 {
+				t.Fatal("nothing written after release")
+			}
+		})
+	}
+}
+
+func TestInterlockAllowsStopsAndOverrides(t *testing.T) {
+	roomba, transport := newTestRoomba(t)
+	roomba.engageInterlock(TripReason{Cause: TripBump})
+
+	if err := roomba.Stop(); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+	if err := roomba.SafeMode(); err != nil {
+		t.Errorf("safe mode: %v", err)
+	}
+	if err := roomba.drive(-100, StraightRadius, true); err != nil {
+		t.Errorf("backoff: %v", err)
+	}
+	if got := len(transport.Frames()); got != 3 {
+		t.Errorf("wrote %d frames, want 3", got)
+	}
+}
+
+func TestCheckHazards(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    SensorData
+		hazard  bool
+		cause   TripCause
+		sensors []string
+	}{
+		{"nothing", SensorData{PacketID: SensorPacketAll}, false, "", nil},
+		{"bump", SensorData{PacketID: SensorPacketAll, BumpLeft: true, BumpRight: true}, true, TripBump, []string{"left", "right"}},
+		{"cliff", SensorData{PacketID: SensorPacketPhysical, CliffFrontRight: true}, true, TripCliff, []string{"front right"}},
+		{"wheel drop beats cliff", SensorData{PacketID: SensorPacketAll, CliffLeft: true, WheelDropCaster: true}, true, TripWheelDrop, []string{"caster"}},
+		{"battery packet has no hazards", SensorData{PacketID: SensorPacketBattery, BumpLeft: true}, false, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, hazard := checkHazards(tt.data)
+			if hazard != tt.hazard {
+				t.Fatalf("hazard = %v, want %v", hazard, tt.hazard)
+			}
+			if reason.Cause != tt.cause || len(reason.Sensors) != len(tt.sensors) {
+				t.Fatalf("reason = %s, want %s %v", reason, tt.cause, tt.sensors)
+			}
+			for i, sensor := range tt.sensors {
+				if reason.Sensors[i] != sensor {
+					t.Errorf("reason = %s, want %s %v", reason, tt.cause, tt.sensors)
+				}
+			}
+		})
+	}
+}
+
+func TestBackOffNeedsSensorFeedback(t *testing.T) {
+	roomba, _ := newTestRoomba(t)
+	if err := roomba.backOff(context.Background(), 100, 100); !errors.Is(err, ErrNoSensorFeedback) {
+		t.Errorf("got %v, want ErrNoSensorFeedback", err)
+	}
+}
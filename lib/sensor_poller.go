@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultSensorPollInterval is how often the poller requests sensor data by default
+const DefaultSensorPollInterval = 100 * time.Millisecond
+
+// ErrPollingRunning is returned when sensor polling is started with different settings while it is running
+var ErrPollingRunning = errors.New("sensor polling is already running")
+
+// SensorPoller repeatedly requests a sensor packet and fans the readings out to subscribers
+type SensorPoller struct {
+	roomba      *Roomba
+	packetID    byte
+	interval    time.Duration
+	latest      SensorData
+	hasLatest   bool
+	lastErr     error
+	failures    failureLog
+	subscribers map[<-chan SensorData]chan SensorData
+	running     bool
+	mu          sync.RWMutex
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+}
+
+// NewSensorPoller creates a poller for the given packet group and rate
+func NewSensorPoller(roomba *Roomba, packetID byte, interval time.Duration) *SensorPoller {
+	if interval <= 0 {
+		interval = DefaultSensorPollInterval
+	}
+
+	return &SensorPoller{
+		roomba:      roomba,
+		packetID:    packetID,
+		interval:    interval,
+		subscribers: make(map[<-chan SensorData]chan SensorData),
+		failures:    failureLog{prefix: "Error polling sensors"},
+	}
+}
+
+// Start begins polling in a separate goroutine
+func (sp *SensorPoller) Start() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.running {
+		return
+	}
+	sp.running = true
+	sp.stopChan = make(chan struct{})
+	sp.doneChan = make(chan struct{})
+
+	go sp.pollLoop(sp.stopChan, sp.doneChan)
+}
+
+// Stop halts polling and waits for the current request to finish.
+// Subscriptions stay open so the poller can be restarted.
+func (sp *SensorPoller) Stop() {
+	sp.mu.Lock()
+	if !sp.running {
+		sp.mu.Unlock()
+		return
+	}
+	sp.running = false
+	close(sp.stopChan)
+	done := sp.doneChan
+	sp.mu.Unlock()
+
+	<-done
+}
+
+// Subscribe returns a channel that receives every new reading.
+// The channel holds only the most recent reading, so slow readers never block the poller.
+func (sp *SensorPoller) Subscribe() <-chan SensorData {
+	return sp.SubscribeBuffered(1)
+}
+
+// SubscribeBuffered returns a channel that queues up to size unread readings.
+// Use it for consumers like odometry that must see every reading; if the
+// buffer fills the oldest unread reading is dropped.
+func (sp *SensorPoller) SubscribeBuffered(size int) <-chan SensorData {
+	if size < 1 {
+		size = 1
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	ch := make(chan SensorData, size)
+	sp.subscribers[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops delivery to a channel returned by Subscribe and closes it
+func (sp *SensorPoller) Unsubscribe(ch <-chan SensorData) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sub, ok := sp.subscribers[ch]; ok {
+		delete(sp.subscribers, ch)
+		close(sub)
+	}
+}
+
+// unsubscribeAll closes every subscription
+func (sp *SensorPoller) unsubscribeAll() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	for ch, sub := range sp.subscribers {
+		delete(sp.subscribers, ch)
+		close(sub)
+	}
+}
+
+// Latest returns the most recent reading and whether one has been received yet
+func (sp *SensorPoller) Latest() (SensorData, bool) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.latest, sp.hasLatest
+}
+
+// PacketID returns the sensor packet group being polled
+func (sp *SensorPoller) PacketID() byte {
+	return sp.packetID
+}
+
+// LastError returns the error from the most recent poll, or nil if it succeeded
+func (sp *SensorPoller) LastError() error {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.lastErr
+}
+
+// pollLoop requests sensor data at the configured interval until stopped
+func (sp *SensorPoller) pollLoop(stopChan, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			data, err := sp.roomba.Sensors(sp.packetID)
+			if err != nil {
+				sp.mu.Lock()
+				sp.failures.fail(err)
+				sp.lastErr = err
+				sp.mu.Unlock()
+				continue
+			}
+
+			sp.publish(data)
+		}
+	}
+}
+
+// publish stores the reading and delivers it to every subscriber
+func (sp *SensorPoller) publish(data SensorData) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.latest = data
+	sp.hasLatest = true
+	sp.lastErr = nil
+	sp.failures.ok()
+
+	for _, sub := range sp.subscribers {
+		// Make room by dropping the oldest unread reading
+		if len(sub) == cap(sub) {
+			select {
+			case <-sub:
+			default:
+			}
+		}
+		sub <- data
+	}
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Sensor packet IDs understood by the SCI Sensors command
+const (
+	SensorPacketAll      byte = 0 // Packets 1, 2 and 3 (26 bytes)
+	SensorPacketPhysical byte = 1 // Bumps, wheel drops, cliffs, walls, dirt (10 bytes)
+	SensorPacketControls byte = 2 // Remote, buttons, distance and angle (6 bytes)
+	SensorPacketBattery  byte = 3 // Charging state and battery readings (10 bytes)
+)
+
+// sensorPacketLengths maps each packet ID to the number of bytes the Roomba replies with
+var sensorPacketLengths = map[byte]int{
+	SensorPacketAll:      26,
+	SensorPacketPhysical: 10,
+	SensorPacketControls: 6,
+	SensorPacketBattery:  10,
+}
+
+// sensorReadTimeout is how long to wait for a complete sensor reply
+const sensorReadTimeout = 500 * time.Millisecond
+
+// portReadTimeout is how long a single port read waits for data. It is short so readFull
+// can hold each command to its own deadline.
+const portReadTimeout = 20 * time.Millisecond
+
+// ErrSensorTimeout is returned when the Roomba does not answer a sensor query in time
+var ErrSensorTimeout = errors.New("timed out waiting for sensor data")
+
+// ChargingState is the charging state reported in sensor packet 3
+type ChargingState byte
+
+const (
+	ChargingStateNotCharging ChargingState = 0
+	ChargingStateRecovery    ChargingState = 1
+	ChargingStateCharging    ChargingState = 2
+	ChargingStateTrickle     ChargingState = 3
+	ChargingStateWaiting     ChargingState = 4
+	ChargingStateError       ChargingState = 5
+)
+
+// String returns a human readable charging state
+func (cs ChargingState) String() string {
+	switch cs {
+	case ChargingStateNotCharging:
+		return "not charging"
+	case ChargingStateRecovery:
+		return "charging recovery"
+	case ChargingStateCharging:
+		return "charging"
+	case ChargingStateTrickle:
+		return "trickle charging"
+	case ChargingStateWaiting:
+		return "waiting"
+	case ChargingStateError:
+		return "charging error"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(cs))
+	}
+}
+
+// SensorData holds the decoded contents of a sensor packet.
+// Only the fields belonging to the requested packet group are filled in.
+type SensorData struct {
+	PacketID  byte      // Packet group that was requested
+	Timestamp time.Time // When the reply was received
+
+	// Packet 1: physical sensors
+	BumpRight         bool
+	BumpLeft          bool
+	WheelDropRight    bool
+	WheelDropLeft     bool
+	WheelDropCaster   bool
+	Wall              bool
+	CliffLeft         bool
+	CliffFrontLeft    bool
+	CliffFrontRight   bool
+	CliffRight        bool
+	VirtualWall       bool
+	MotorOvercurrents byte // Bit flags: drive left, drive right, main brush, vacuum, side brush
+	DirtLeft          byte // Dirt detector left, 0-255
+	DirtRight         byte // Dirt detector right, 0-255
+
+	// Packet 2: buttons and internal sensors
+	RemoteOpcode byte // Command from the remote control, 255 when none
+	ButtonMax    bool
+	ButtonClean  bool
+	ButtonSpot   bool
+	ButtonPower  bool
+	Distance     int16 // Distance travelled since the last request in mm
+	Angle        int16 // Wheel distance difference since the last request in mm
+
+	// Packet 3: battery
+	ChargingState ChargingState
+	Voltage       uint16 // Battery voltage in mV
+	Current       int16  // Battery current in mA, negative when discharging
+	Temperature   int8   // Battery temperature in degrees C
+	Charge        uint16 // Battery charge in mAh
+	Capacity      uint16 // Estimated battery capacity in mAh
+}
+
+// Bumped reports whether either bumper is pressed
+func (sd SensorData) Bumped() bool {
+	return sd.BumpLeft || sd.BumpRight
+}
+
+// CliffDetected reports whether any cliff sensor sees a drop
+func (sd SensorData) CliffDetected() bool {
+	return sd.CliffLeft || sd.CliffFrontLeft || sd.CliffFrontRight || sd.CliffRight
+}
+
+// WheelDropped reports whether any wheel has lost contact with the floor
+func (sd SensorData) WheelDropped() bool {
+	return sd.WheelDropLeft || sd.WheelDropRight || sd.WheelDropCaster
+}
+
+// AngleDegrees converts the raw angle reading to degrees (counter-clockwise is positive)
+func (sd SensorData) AngleDegrees() float64 {
+	return (360 * float64(sd.Angle)) / (258 * math.Pi)
+}
+
+// Sensors requests a sensor packet group from the Roomba and decodes the reply
+func (r *Roomba) Sensors(packetID byte) (SensorData, error) {
+	length, ok := sensorPacketLengths[packetID]
+	if !ok {
+		return SensorData{}, fmt.Errorf("unsupported sensor packet %d", packetID)
+	}
+
+	buf, err := r.submit(&command{
+		frame:    []byte{r.Cmds.CmdSensors, packetID},
+		replyLen: length,
+	})
+	if err != nil {
+		return SensorData{}, fmt.Errorf("failed to read sensor packet %d: %w", packetID, err)
+	}
+
+	return decodeSensorPacket(packetID, buf, time.Now()), nil
+}
+
+// readFull reads exactly len(buf) bytes from the port or gives up after timeout
+func (r *Roomba) readFull(buf []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	read := 0
+	for read < len(buf) {
+		n, err := r.port.Read(buf[read:])
+		if err != nil {
+			return err
+		}
+		read += n
+
+		// The port returns no data once its own read timeout elapses
+		if n == 0 && time.Now().After(deadline) {
+			return ErrSensorTimeout
+		}
+	}
+	return nil
+}
+
+// decodeSensorPacket decodes the raw reply for the given packet group
+func decodeSensorPacket(packetID byte, data []byte, timestamp time.Time) SensorData {
+	sd := SensorData{
+		PacketID:  packetID,
+		Timestamp: timestamp,
+	}
+
+	switch packetID {
+	case SensorPacketAll:
+		decodePhysicalSensors(data[0:10], &sd)
+		decodeControlSensors(data[10:16], &sd)
+		decodeBatterySensors(data[16:26], &sd)
+	case SensorPacketPhysical:
+		decodePhysicalSensors(data, &sd)
+	case SensorPacketControls:
+		decodeControlSensors(data, &sd)
+	case SensorPacketBattery:
+		decodeBatterySensors(data, &sd)
+	}
+
+	return sd
+}
+
+// decodePhysicalSensors decodes the 10 bytes of packet 1
+func decodePhysicalSensors(data []byte, sd *SensorData) {
+	sd.BumpRight = data[0]&0x01 != 0
+	sd.BumpLeft = data[0]&0x02 != 0
+	sd.WheelDropRight = data[0]&0x04 != 0
+	sd.WheelDropLeft = data[0]&0x08 != 0
+	sd.WheelDropCaster = data[0]&0x10 != 0
+	sd.Wall = data[1] != 0
+	sd.CliffLeft = data[2] != 0
+	sd.CliffFrontLeft = data[3] != 0
+	sd.CliffFrontRight = data[4] != 0
+	sd.CliffRight = data[5] != 0
+	sd.VirtualWall = data[6] != 0
+	sd.MotorOvercurrents = data[7] & 0x1F
+	sd.DirtLeft = data[8]
+	sd.DirtRight = data[9]
+}
+
+// decodeControlSensors decodes the 6 bytes of packet 2
+func decodeControlSensors(data []byte, sd *SensorData) {
+	sd.RemoteOpcode = data[0]
+	sd.ButtonMax = data[1]&0x01 != 0
+	sd.ButtonClean = data[1]&0x02 != 0
+	sd.ButtonSpot = data[1]&0x04 != 0
+	sd.ButtonPower = data[1]&0x08 != 0
+	sd.Distance = int16(uint16(data[2])<<8 | uint16(data[3]))
+	sd.Angle = int16(uint16(data[4])<<8 | uint16(data[5]))
+}
+
+// decodeBatterySensors decodes the 10 bytes of packet 3
+func decodeBatterySensors(data []byte, sd *SensorData) {
+	sd.ChargingState = ChargingState(data[0])
+	sd.Voltage = uint16(data[1])<<8 | uint16(data[2])
+	sd.Current = int16(uint16(data[3])<<8 | uint16(data[4]))
+	sd.Temperature = int8(data[5])
+	sd.Charge = uint16(data[6])<<8 | uint16(data[7])
+	sd.Capacity = uint16(data[8])<<8 | uint16(data[9])
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Raw replies for each part of sensor group 0
+var (
+	physicalReply = []byte{
+		0x12,       // Left bumper and caster wheel drop
+		1,          // Wall
+		0, 1, 0, 1, // Cliff left, front left, front right, right
+		0,    // Virtual wall
+		0xFF, // Overcurrents, only the low five bits are used
+		7, 9, // Dirt left and right
+	}
+	controlsReply = []byte{
+		0x88,       // Remote opcode
+		0x05,       // Max and spot buttons
+		0xFF, 0xF6, // Distance -10 mm
+		0x00, 0x2D, // Angle 45 mm
+	}
+	batteryReply = []byte{
+		2,          // Charging
+		0x3A, 0x98, // 15000 mV
+		0xFC, 0x18, // -1000 mA
+		0xE2,       // -30 degrees C
+		0x0B, 0xB8, // 3000 mAh charge
+		0x0F, 0xA0, // 4000 mAh capacity
+	}
+)
+
+// Decoded values of the replies above
+var (
+	physicalData = SensorData{
+		BumpLeft:          true,
+		WheelDropCaster:   true,
+		Wall:              true,
+		CliffFrontLeft:    true,
+		CliffRight:        true,
+		MotorOvercurrents: 0x1F,
+		DirtLeft:          7,
+		DirtRight:         9,
+	}
+	controlsData = SensorData{
+		RemoteOpcode: 0x88,
+		ButtonMax:    true,
+		ButtonSpot:   true,
+		Distance:     -10,
+		Angle:        45,
+	}
+	batteryData = SensorData{
+		ChargingState: ChargingStateCharging,
+		Voltage:       15000,
+		Current:       -1000,
+		Temperature:   -30,
+		Charge:        3000,
+		Capacity:      4000,
+	}
+)
+
+func TestDecodeSensorPacket(t *testing.T) {
+	all := append(append(append([]byte(nil), physicalReply...), controlsReply...), batteryReply...)
+	combined := physicalData
+	combined.RemoteOpcode = controlsData.RemoteOpcode
+	combined.ButtonMax = controlsData.ButtonMax
+	combined.ButtonSpot = controlsData.ButtonSpot
+	combined.Distance = controlsData.Distance
+	combined.Angle = controlsData.Angle
+	combined.ChargingState = batteryData.ChargingState
+	combined.Voltage = batteryData.Voltage
+	combined.Current = batteryData.Current
+	combined.Temperature = batteryData.Temperature
+	combined.Charge = batteryData.Charge
+	combined.Capacity = batteryData.Capacity
+
+	tests := []struct {
+		name     string
+		packetID byte
+		data     []byte
+		want     SensorData
+	}{
+		{"group 0", SensorPacketAll, all, combined},
+		{"group 1", SensorPacketPhysical, physicalReply, physicalData},
+		{"group 2", SensorPacketControls, controlsReply, controlsData},
+		{"group 3", SensorPacketBattery, batteryReply, batteryData},
+	}
+
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.data) != sensorPacketLengths[tt.packetID] {
+				t.Fatalf("reply is %d bytes, packet %d is %d", len(tt.data), tt.packetID, sensorPacketLengths[tt.packetID])
+			}
+
+			want := tt.want
+			want.PacketID = tt.packetID
+			want.Timestamp = now
+			if got := decodeSensorPacket(tt.packetID, tt.data, now); got != want {
+				t.Errorf("got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSensorsQuery(t *testing.T) {
+	roomba, transport := newTestRoomba(t)
+	transport.SetSensorResponse(SensorPacketBattery, batteryReply)
+
+	data, err := roomba.Sensors(SensorPacketBattery)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := lastFrame(t, transport); !bytes.Equal(got, []byte{142, SensorPacketBattery}) {
+		t.Errorf("frame = % X, want 8E 03", got)
+	}
+	if data.Charge != batteryData.Charge || data.Capacity != batteryData.Capacity {
+		t.Errorf("charge %d/%d mAh, want %d/%d", data.Charge, data.Capacity, batteryData.Charge, batteryData.Capacity)
+	}
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits of the Drive command from the SCI specification
+const (
+	MaxVelocity int16 = 500  // mm/s
+	MaxRadius   int16 = 2000 // mm
+
+	// Special radius values
+	StraightRadiusAlt          int16 = -32768 // 0x8000, also means straight
+	SpinClockwiseRadius        int16 = -1
+	SpinCounterClockwiseRadius int16 = 1
+)
+
+var (
+	// ErrVelocityOutOfRange is returned when a velocity exceeds the speed limit
+	ErrVelocityOutOfRange = errors.New("velocity out of range")
+	// ErrRadiusOutOfRange is returned when a radius is neither in range nor a special value
+	ErrRadiusOutOfRange = errors.New("radius out of range")
+)
+
+// SpeedLimitPolicy decides what happens to motion commands that exceed the limits
+type SpeedLimitPolicy int
+
+const (
+	SpeedLimitReject SpeedLimitPolicy = iota // Return an error and send nothing
+	SpeedLimitClamp                          // Clamp to the nearest allowed value and send
+)
+
+// String returns the policy name
+func (p SpeedLimitPolicy) String() string {
+	switch p {
+	case SpeedLimitReject:
+		return "reject"
+	case SpeedLimitClamp:
+		return "clamp"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(p))
+	}
+}
+
+// SpeedLimits is the soft speed limit applied to every motion command
+type SpeedLimits struct {
+	MaxVelocity int16            // Fastest allowed wheel or body speed in mm/s, at most 500
+	Policy      SpeedLimitPolicy // Whether to reject or clamp commands over the limit
+}
+
+// DefaultSpeedLimits allows the full hardware range and rejects anything outside it
+func DefaultSpeedLimits() SpeedLimits {
+	return SpeedLimits{
+		MaxVelocity: MaxVelocity,
+		Policy:      SpeedLimitReject,
+	}
+}
+
+// SetSpeedLimits changes the soft speed limit for subsequent motion commands
+func (r *Roomba) SetSpeedLimits(limits SpeedLimits) error {
+	if limits.MaxVelocity <= 0 || limits.MaxVelocity > MaxVelocity {
+		return fmt.Errorf("max velocity %d must be between 1 and %d", limits.MaxVelocity, MaxVelocity)
+	}
+	if limits.Policy != SpeedLimitReject && limits.Policy != SpeedLimitClamp {
+		return fmt.Errorf("unknown speed limit policy %d", limits.Policy)
+	}
+
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+	r.limits = limits
+	return nil
+}
+
+// SpeedLimits returns the soft speed limit in effect
+func (r *Roomba) SpeedLimits() SpeedLimits {
+	r.limitsMu.RLock()
+	defer r.limitsMu.RUnlock()
+	return r.limits
+}
+
+// limitVelocity applies the speed limit policy to a velocity
+func (r *Roomba) limitVelocity(name string, velocity int16) (int16, error) {
+	limits := r.SpeedLimits()
+	return applyLimit(name, velocity, limits.MaxVelocity, limits.Policy, ErrVelocityOutOfRange)
+}
+
+// limitRadius applies the speed limit policy to a Drive radius, letting special values through
+func (r *Roomba) limitRadius(radius int16) (int16, error) {
+	if radius == StraightRadius || radius == StraightRadiusAlt {
+		return StraightRadius, nil
+	}
+	return applyLimit("radius", radius, MaxRadius, r.SpeedLimits().Policy, ErrRadiusOutOfRange)
+}
+
+// applyLimit rejects or clamps a value outside -limit..limit
+func applyLimit(name string, value, limit int16, policy SpeedLimitPolicy, errOutOfRange error) (int16, error) {
+	if value >= -limit && value <= limit {
+		return value, nil
+	}
+
+	if policy == SpeedLimitClamp {
+		if value > limit {
+			return limit, nil
+		}
+		return -limit, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s %d not in -%d..%d", errOutOfRange, name, value, limit, limit)
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestApplyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   int16
+		policy  SpeedLimitPolicy
+		want    int16
+		wantErr bool
+	}{
+		{"within the limit", 250, SpeedLimitReject, 250, false},
+		{"at the upper limit", 300, SpeedLimitReject, 300, false},
+		{"at the lower limit", -300, SpeedLimitReject, -300, false},
+		{"above the limit rejected", 301, SpeedLimitReject, 0, true},
+		{"below the limit rejected", -301, SpeedLimitReject, 0, true},
+		{"most negative rejected", -32768, SpeedLimitReject, 0, true},
+		{"within the limit clamped", -250, SpeedLimitClamp, -250, false},
+		{"above the limit clamped", 32767, SpeedLimitClamp, 300, false},
+		{"below the limit clamped", -301, SpeedLimitClamp, -300, false},
+		{"most negative clamped", -32768, SpeedLimitClamp, -300, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyLimit("velocity", tt.value, 300, tt.policy, ErrVelocityOutOfRange)
+			if tt.wantErr {
+				if !errors.Is(err, ErrVelocityOutOfRange) {
+					t.Fatalf("got %d, %v, want ErrVelocityOutOfRange", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriveSpeedLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   SpeedLimitPolicy
+		velocity int16
+		radius   int16
+		want     []byte
+		wantErr  error
+	}{
+		{"reject fast velocity", SpeedLimitReject, 301, StraightRadius, nil, ErrVelocityOutOfRange},
+		{"clamp fast velocity", SpeedLimitClamp, 301, StraightRadius, []byte{137, 0x01, 0x2C, 0x7F, 0xFF}, nil},
+		{"reject wide radius", SpeedLimitReject, 100, 2001, nil, ErrRadiusOutOfRange},
+		{"clamp wide radius", SpeedLimitClamp, 100, -2001, []byte{137, 0x00, 0x64, 0xF8, 0x30}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomba, transport := newTestRoomba(t)
+			if err := roomba.SetSpeedLimits(SpeedLimits{MaxVelocity: 300, Policy: tt.policy}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := roomba.Drive(tt.velocity, tt.radius)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				if frames := transport.Frames(); len(frames) != 0 {
+					t.Errorf("wrote % X, want nothing", frames)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := lastFrame(t, transport); !bytes.Equal(got, tt.want) {
+				t.Errorf("frame = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
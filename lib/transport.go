@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Transport is the byte stream used to talk to the Roomba.
+// A go.bug.st/serial port satisfies it directly.
+type Transport interface {
+	Write(p []byte) (int, error)
+	Read(p []byte) (int, error)
+	SetRTS(rts bool) error
+	Close() error
+}
+
+// readTimeoutSetter is implemented by transports whose reads can be bounded
+type readTimeoutSetter interface {
+	SetReadTimeout(t time.Duration) error
+}
+
+// inputBufferResetter is implemented by transports that can discard unread input
+type inputBufferResetter interface {
+	ResetInputBuffer() error
+}
+
+// tcpPrefix marks a port name as a TCP address, e.g. tcp://192.168.1.30:2000
+const tcpPrefix = "tcp://"
+
+// OpenTransport opens a serial port, or a TCP socket when the name starts with tcp://
+func OpenTransport(portName string, baudRate int) (Transport, error) {
+	if strings.HasPrefix(portName, tcpPrefix) {
+		return DialTCPTransport(strings.TrimPrefix(portName, tcpPrefix))
+	}
+
+	mode := &serial.Mode{
+		BaudRate: baudRate,
+		Parity:   serial.NoParity,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+	}
+
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+	return port, nil
+}
+
+// TCPTransport talks to a Roomba through a serial-to-network bridge such as ser2net
+type TCPTransport struct {
+	conn        net.Conn
+	readTimeout time.Duration
+}
+
+// DialTCPTransport connects to a serial bridge at the given host:port
+func DialTCPTransport(address string) (*TCPTransport, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	return &TCPTransport{conn: conn}, nil
+}
+
+// Write sends bytes to the bridge
+func (t *TCPTransport) Write(p []byte) (int, error) {
+	return t.conn.Write(p)
+}
+
+// Read reads from the bridge, returning no data once the read timeout elapses
+func (t *TCPTransport) Read(p []byte) (int, error) {
+	if t.readTimeout > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
+
+	n, err := t.conn.Read(p)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// Match serial port semantics where a timeout is not an error
+		return n, nil
+	}
+	return n, err
+}
+
+// SetRTS is a no-op since the bridge owns the control lines
+func (t *TCPTransport) SetRTS(rts bool) error {
+	return nil
+}
+
+// SetReadTimeout bounds how long Read waits for data
+func (t *TCPTransport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeout = timeout
+	return nil
+}
+
+// Close closes the connection
+func (t *TCPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// FakeTransport is an in-memory transport that records every byte sent
+// and answers sensor queries with scripted responses
+type FakeTransport struct {
+	mu              sync.Mutex
+	written         []byte
+	frames          [][]byte
+	pending         []byte
+	sensorResponses map[byte][]byte
+	rts             bool
+	readTimeout     time.Duration
+	closed          bool
+}
+
+// NewFakeTransport creates an empty fake transport
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{
+		sensorResponses: make(map[byte][]byte),
+		readTimeout:     10 * time.Millisecond,
+	}
+}
+
+// Write records the bytes and queues any scripted sensor response
+func (f *FakeTransport) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errors.New("fake transport closed")
+	}
+
+	frame := append([]byte(nil), p...)
+	f.written = append(f.written, frame...)
+	f.frames = append(f.frames, frame)
+
+	// Answer sensor queries the way the Roomba would
+	if len(frame) == 2 && frame[0] == 142 {
+		if resp, ok := f.sensorResponses[frame[1]]; ok {
+			f.pending = append(f.pending, resp...)
+		}
+	}
+	return len(p), nil
+}
+
+// Read returns queued response bytes, or no data after the read timeout
+func (f *FakeTransport) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(f.getReadTimeout())
+	for {
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return 0, errors.New("fake transport closed")
+		}
+		if len(f.pending) > 0 {
+			n := copy(p, f.pending)
+			f.pending = f.pending[n:]
+			f.mu.Unlock()
+			return n, nil
+		}
+		f.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// SetRTS records the RTS line state
+func (f *FakeTransport) SetRTS(rts bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rts = rts
+	return nil
+}
+
+// SetReadTimeout bounds how long Read waits for data
+func (f *FakeTransport) SetReadTimeout(timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readTimeout = timeout
+	return nil
+}
+
+// ResetInputBuffer discards unread response bytes
+func (f *FakeTransport) ResetInputBuffer() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = nil
+	return nil
+}
+
+// Close marks the transport closed
+func (f *FakeTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// SetSensorResponse scripts the reply sent whenever the given sensor packet is requested
+func (f *FakeTransport) SetSensorResponse(packetID byte, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sensorResponses[packetID] = append([]byte(nil), data...)
+}
+
+// QueueResponse appends raw bytes to be returned by the next reads
+func (f *FakeTransport) QueueResponse(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, data...)
+}
+
+// Written returns every byte written so far
+func (f *FakeTransport) Written() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte(nil), f.written...)
+}
+
+// Frames returns each Write call as a separate frame
+func (f *FakeTransport) Frames() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	frames := make([][]byte, len(f.frames))
+	for i, frame := range f.frames {
+		frames[i] = append([]byte(nil), frame...)
+	}
+	return frames
+}
+
+// Reset clears the recorded writes
+func (f *FakeTransport) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = nil
+	f.frames = nil
+}
+
+// RTS returns the last RTS line state that was set
+func (f *FakeTransport) RTS() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rts
+}
+
+// getReadTimeout returns the read timeout under the lock
+func (f *FakeTransport) getReadTimeout() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readTimeout
+}
@@ -1,6 +1,29 @@
 package lib
 
-import "net"
+import (
+	"log"
+	"net"
+)
+
+// failureLog logs only the first error of a run of failures, so a loop that keeps
+// failing the same way doesn't flood the log. It is not safe for concurrent use.
+type failureLog struct {
+	prefix  string // Printed before the error, e.g. "Error polling sensors"
+	failing bool
+}
+
+// fail logs err if it starts a new run of failures
+func (fl *failureLog) fail(err error) {
+	if !fl.failing {
+		log.Printf("%s: %v", fl.prefix, err)
+	}
+	fl.failing = true
+}
+
+// ok ends the current run of failures, so the next one is logged
+func (fl *failureLog) ok() {
+	fl.failing = false
+}
 
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"log"
+	"time"
+)
+
+// DefaultMotionLease is a lease window short enough to stop a runaway robot quickly,
+// but long enough to ride out a slow network round trip
+const DefaultMotionLease = time.Second
+
+// SetMotionLease makes every motion command hold a lease for the given window.
+// Unless the lease is renewed by another motion command or a Heartbeat, the robot
+// is stopped when it runs out. A window of 0 disables the watchdog.
+func (r *Roomba) SetMotionLease(window time.Duration) {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+
+	r.leaseWindow = window
+	if window <= 0 {
+		r.stopLeaseLocked()
+	}
+}
+
+// MotionLease returns the lease window, 0 if the watchdog is disabled
+func (r *Roomba) MotionLease() time.Duration {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	return r.leaseWindow
+}
+
+// Heartbeat renews the lease of the current motion command.
+// It does nothing if the robot is not moving under a lease.
+func (r *Roomba) Heartbeat() {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+
+	if r.leaseActive {
+		r.leaseDeadline = time.Now().Add(r.leaseWindow)
+	}
+}
+
+// renewLease starts or extends the lease after a motion command was sent
+func (r *Roomba) renewLease() {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+
+	if r.leaseWindow <= 0 {
+		return
+	}
+
+	r.leaseActive = true
+	r.leaseDeadline = time.Now().Add(r.leaseWindow)
+	if r.leaseTimer == nil {
+		r.leaseTimer = time.AfterFunc(r.leaseWindow, r.checkLease)
+	} else {
+		r.leaseTimer.Reset(r.leaseWindow)
+	}
+}
+
+// cancelLease ends the lease once the robot has been told to stop
+func (r *Roomba) cancelLease() {
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	r.stopLeaseLocked()
+}
+
+// stopLeaseLocked ends the lease, the caller must hold leaseMu
+func (r *Roomba) stopLeaseLocked() {
+	r.leaseActive = false
+	if r.leaseTimer != nil {
+		r.leaseTimer.Stop()
+	}
+}
+
+// checkLease runs when the lease timer fires and stops the robot unless the lease was renewed
+func (r *Roomba) checkLease() {
+	r.leaseMu.Lock()
+	if !r.leaseActive {
+		r.leaseMu.Unlock()
+		return
+	}
+
+	// Heartbeats only move the deadline, so wait for the rest of the lease
+	if remaining := time.Until(r.leaseDeadline); remaining > 0 {
+		r.leaseTimer.Reset(remaining)
+		r.leaseMu.Unlock()
+		return
+	}
+	r.leaseActive = false
+	r.leaseMu.Unlock()
+
+	log.Println("Motion lease expired - Stopping")
+	if err := r.Stop(); err != nil {
+		log.Printf("Error stopping Roomba after lease expired: %v", err)
+	}
+}